@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"frith/common"
+	_ "github.com/joho/godotenv/autoload"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Prints the moderation audit log, newest first. The relay must be stopped while this runs,
+// since it opens the database directly.
+func main() {
+	actor := flag.String("actor", "", "only show actions taken by this pubkey")
+	action := flag.String("action", "", "only show this action, for example banpubkey")
+	target := flag.String("target", "", "only show actions taken on this pubkey, event, or group")
+	since := flag.String("since", "", "only show actions after this time, as a unix timestamp or a duration ago like 24h")
+	until := flag.String("until", "", "only show actions before this time, as a unix timestamp or a duration ago like 24h")
+	limit := flag.Int("limit", 100, "the maximum number of entries to show, or 0 for all")
+	asJSON := flag.Bool("json", false, "print entries as JSON lines")
+	flag.Parse()
+
+	common.SetupEnvironment()
+
+	defer common.GetDatabase().Close()
+
+	entries := common.QueryAuditLog(common.AuditFilter{
+		Actor:  *actor,
+		Action: *action,
+		Target: *target,
+		Since:  parseTime(*since),
+		Until:  parseTime(*until),
+		Limit:  *limit,
+	})
+
+	for _, entry := range entries {
+		if *asJSON {
+			data, _ := json.Marshal(entry)
+			fmt.Println(string(data))
+		} else {
+			fmt.Printf(
+				"%s\t%s\t%s\t%s\t%s\n",
+				entry.CreatedAt.Time().Format(time.RFC3339),
+				entry.Actor,
+				entry.Action,
+				entry.Target,
+				entry.Reason,
+			)
+		}
+	}
+}
+
+func parseTime(s string) nostr.Timestamp {
+	if s == "" {
+		return 0
+	}
+
+	if ts, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return nostr.Timestamp(ts)
+	}
+
+	if d, err := time.ParseDuration(s); err == nil {
+		return nostr.Timestamp(time.Now().Add(-d).Unix())
+	}
+
+	log.Fatalf("Invalid time %s, expected a unix timestamp or a duration", s)
+
+	return 0
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+
+	"frith/common"
+	_ "github.com/joho/godotenv/autoload"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Rotates the relay's signing key. Pass a hex secret to use, or omit it to generate one.
+// Stop the relay before running this, and remove RELAY_SECRET from the environment
+// afterwards if it was set.
+func main() {
+	common.SetupEnvironment()
+
+	if common.RELAY_BUNKER != "" || common.RELAY_NCRYPTSEC != "" {
+		log.Fatal("Only keys stored in RELAY_SECRET or DATA_DIR can be rotated")
+	}
+
+	defer common.GetBackend().Close()
+
+	// Finish an interrupted rotation before starting another one
+	if rotation := common.GetKeyRotation(); rotation != nil {
+		count, err := common.ResumeKeyRotation(context.Background())
+		if err != nil {
+			log.Fatal("Failed to resume relay secret rotation: ", err)
+		}
+
+		fmt.Printf("Re-signed %d events\n", count)
+		fmt.Printf("Finished changing the relay pubkey from %s to %s\n", rotation.From, rotation.To)
+
+		return
+	}
+
+	newSecret := nostr.GeneratePrivateKey()
+	if len(os.Args) > 1 {
+		newSecret = os.Args[1]
+	}
+
+	oldSelf := common.RELAY_SELF
+
+	count, err := common.RotateRelaySecret(context.Background(), newSecret)
+	if err != nil {
+		if common.GetKeyRotation() != nil {
+			log.Fatal("Relay secret rotation was interrupted, run this again to finish it: ", err)
+		}
+
+		log.Fatal("Failed to rotate relay secret: ", err)
+	}
+
+	fmt.Printf("Re-signed %d events\n", count)
+	fmt.Printf("Relay pubkey changed from %s to %s\n", oldSelf, common.RELAY_SELF)
+
+	if os.Getenv("RELAY_SECRET") != "" {
+		fmt.Printf("RELAY_SECRET is set, remove it so that the new key in %s is used\n", common.GetRelaySecretPath())
+	}
+}
@@ -2,9 +2,11 @@ package common
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
-	"net/http"
+	"log"
 	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -20,120 +22,754 @@ const (
 	AUTH_INVITE = 28935
 )
 
+// Capabilities which may be granted to a pubkey
+
+const (
+	CAP_READ   = "read"
+	CAP_WRITE  = "write"
+	CAP_UPLOAD = "upload"
+	CAP_GROUPS = "groups"
+	CAP_INVITE = "invite"
+)
+
+var CAPABILITIES = []string{CAP_READ, CAP_WRITE, CAP_UPLOAD, CAP_GROUPS, CAP_INVITE}
+
+// Creating a group makes its creator an admin of it, so that has to be granted through a tier.
+// Everything else is granted by claims without a tier and by sources other than claims.
+var DEFAULT_CAPABILITIES = []string{CAP_READ, CAP_WRITE, CAP_UPLOAD, CAP_INVITE}
+
 // Claims defined statically and consumed by user
 
 func IsValidClaim(claim string) bool {
 	return slices.Contains(RELAY_CLAIMS, claim)
 }
 
+// GetClaimTier returns the tier granted by a claim. Claims not found in RELAY_CLAIMS were
+// paid for, granted by approving an application, or issued by members as invites.
+func GetClaimTier(claim string) string {
+	if IsValidClaim(claim) {
+		return RELAY_CLAIM_TIERS[claim]
+	}
+
+	if claim == PAID_CLAIM {
+		return RELAY_PAYMENT_TIER
+	}
+
+	if claim == APPLICATION_CLAIM {
+		return RELAY_APPLICATION_TIER
+	}
+
+	return RELAY_INVITE_TIER
+}
+
+// GetClaimCapabilities returns the capabilities granted by a claim. Claims without a tier
+// grant DEFAULT_CAPABILITIES.
+func GetClaimCapabilities(claim string) []string {
+	tier := GetClaimTier(claim)
+
+	if tier == "" {
+		return DEFAULT_CAPABILITIES
+	}
+
+	return RELAY_TIERS[tier]
+}
+
+// UserClaim is a claim held by a user, along with when it was granted. Claims with an
+// expiry stop granting access once it passes.
+type UserClaim struct {
+	Claim   string          `json:"claim"`
+	Granted nostr.Timestamp `json:"granted,omitempty"`
+	Expires nostr.Timestamp `json:"expires,omitempty"`
+}
+
+func (c UserClaim) IsExpired() bool {
+	return c.Expires != 0 && c.Expires < nostr.Now()
+}
+
+func GetUserClaimRecords(pubkey string) []UserClaim {
+	var records []UserClaim
+
+	data := GetItem("claim", pubkey)
+
+	if err := json.Unmarshal(data, &records); err != nil {
+		// Claims used to be stored as a comma-separated list
+		records = make([]UserClaim, 0)
+		for _, claim := range Split(string(data), ",") {
+			records = append(records, UserClaim{Claim: claim})
+		}
+	}
+
+	return records
+}
+
+func PutUserClaimRecords(pubkey string, records []UserClaim) {
+	if len(records) == 0 {
+		DeleteItem("claim", pubkey)
+		return
+	}
+
+	data, err := json.Marshal(records)
+	if err != nil {
+		log.Println(err)
+	} else {
+		PutItem("claim", pubkey, data)
+	}
+}
+
+// GetUserClaims returns the claims held by a user which haven't expired
 func GetUserClaims(pubkey string) []string {
-	return Split(string(GetItem("claim", pubkey)), ",")
+	claims := make([]string, 0)
+
+	for _, record := range GetUserClaimRecords(pubkey) {
+		if !record.IsExpired() {
+			claims = append(claims, record.Claim)
+		}
+	}
+
+	return claims
 }
 
+// AddUserClaim grants a claim, or renews it if the user already holds it. If RELAY_CLAIM_TTL
+// is set, the claim expires after that long.
 func AddUserClaim(pubkey string, claim string) {
-	claims := GetUserClaims(pubkey)
+	GrantUserClaim(pubkey, claim, RELAY_CLAIM_TTL)
+}
+
+// GrantUserClaim grants or renews a claim for ttl, or permanently if ttl is zero. Renewing
+// never shortens a claim. The new expiry is returned.
+func GrantUserClaim(pubkey string, claim string, ttl time.Duration) nostr.Timestamp {
+	now := nostr.Now()
+	records := GetUserClaimRecords(pubkey)
+	idx := slices.IndexFunc(records, func(r UserClaim) bool { return r.Claim == claim })
+
+	expires := nostr.Timestamp(0)
+	if ttl > 0 {
+		expires = now + nostr.Timestamp(ttl.Seconds())
+	}
+
+	if idx == -1 {
+		records = append(records, UserClaim{Claim: claim, Granted: now, Expires: expires})
+	} else {
+		record := &records[idx]
+
+		if record.IsExpired() {
+			record.Granted = now
+		}
+
+		if record.Expires != 0 && (expires == 0 || expires > record.Expires) {
+			record.Expires = expires
+		}
+
+		expires = record.Expires
+	}
+
+	PutUserClaimRecords(pubkey, records)
+
+	return expires
+}
+
+// ExtendUserClaim grants a claim for the given period, starting from its current expiry if
+// it hasn't lapsed yet. A period of zero grants it permanently. The new expiry is returned.
+func ExtendUserClaim(pubkey string, claim string, period time.Duration) nostr.Timestamp {
+	if period == 0 {
+		return GrantUserClaim(pubkey, claim, 0)
+	}
+
+	now := nostr.Now()
+	records := GetUserClaimRecords(pubkey)
+	idx := slices.IndexFunc(records, func(r UserClaim) bool { return r.Claim == claim })
+
+	if idx == -1 {
+		expires := now + nostr.Timestamp(period.Seconds())
+		PutUserClaimRecords(pubkey, append(records, UserClaim{Claim: claim, Granted: now, Expires: expires}))
+
+		return expires
+	}
+
+	record := &records[idx]
+
+	// Claims without an expiry are already permanent
+	if record.Expires == 0 {
+		return 0
+	}
+
+	if record.IsExpired() {
+		record.Granted = now
+		record.Expires = now
+	}
 
-	if !slices.Contains(claims, claim) {
-		claims = append(claims, claim)
+	record.Expires += nostr.Timestamp(period.Seconds())
 
-		PutItem("claim", pubkey, []byte(strings.Join(claims, ",")))
+	PutUserClaimRecords(pubkey, records)
+
+	return record.Expires
+}
+
+// PruneExpiredClaims removes lapsed claims, and returns the pubkeys which no longer hold any.
+func PruneExpiredClaims() []string {
+	lapsed := make([]string, 0)
+
+	for pubkey := range ListItems("claim") {
+		records := GetUserClaimRecords(pubkey)
+		active := Filter(records, func(r UserClaim) bool { return !r.IsExpired() })
+
+		if len(active) == len(records) {
+			continue
+		}
+
+		PutUserClaimRecords(pubkey, active)
+
+		for _, record := range records {
+			if record.IsExpired() {
+				AuditWithDetails(RELAY_SELF, "expireclaim", pubkey, "", map[string]any{"claim": record.Claim})
+			}
+		}
+
+		if len(active) == 0 {
+			lapsed = append(lapsed, pubkey)
+		}
 	}
+
+	return lapsed
+}
+
+// Invites issued by members. Each invite is also indexed under its author, so that looking up
+// a member's invites doesn't require scanning every invite.
+
+var inviteIndexOnce sync.Once
+
+func getInviteIndexTable(author string) string {
+	return "authorinvites:" + author
 }
 
-// Invites issued by members
+// migrateInviteIndex indexes invites issued before the index existed. Members used to be given
+// a new invite on every request, so only their most recent invites up to their quota are kept,
+// and the most recent of all becomes their active invite.
+func migrateInviteIndex() {
+	if HasItem("migration", "inviteindex") {
+		return
+	}
+
+	invites := ListItems("invite")
+	byAuthor := make(map[string][]string)
+
+	for _, claim := range ListKeysByAge("invite") {
+		author := invites[claim]
+		byAuthor[author] = append(byAuthor[author], claim)
+	}
+
+	now := []byte(strconv.FormatInt(int64(nostr.Now()), 10))
+	pruned := 0
+
+	for author, claims := range byAuthor {
+		keep := min(len(claims), max(GetInviteQuota(author), 0))
+
+		for _, claim := range claims[:len(claims)-keep] {
+			DeleteItem("invite", claim)
+			pruned++
+		}
+
+		for _, claim := range claims[len(claims)-keep:] {
+			PutItem(getInviteIndexTable(author), claim, now)
+		}
+
+		if keep > 0 {
+			PutItem("activeinvite", author, []byte(claims[len(claims)-1]))
+		}
+	}
+
+	if pruned > 0 {
+		log.Printf("Pruned %d invites over their author's quota", pruned)
+	}
+
+	PutItem("migration", "inviteindex", []byte{})
+}
 
 func GenerateInvite(author string) string {
 	claim := RandomString(8)
 
 	PutItem("invite", claim, []byte(author))
+	PutItem(getInviteIndexTable(author), claim, []byte(strconv.FormatInt(int64(nostr.Now()), 10)))
+	PutItem("activeinvite", author, []byte(claim))
 
 	return claim
 }
 
+// GetInviteCreatedAt returns when an invite was issued, which is used as the timestamp of its
+// invite event so that the event stays the same each time it's requested.
+func GetInviteCreatedAt(author string, claim string) nostr.Timestamp {
+	table := getInviteIndexTable(author)
+
+	if ts, err := strconv.ParseInt(string(GetItem(table, claim)), 10, 64); err == nil {
+		return nostr.Timestamp(ts)
+	}
+
+	// Invites indexed before timestamps were recorded get one the first time they're requested
+	now := nostr.Now()
+	PutItem(table, claim, []byte(strconv.FormatInt(int64(now), 10)))
+
+	return now
+}
+
+func DeleteInvite(author string, claim string) {
+	DeleteItem("invite", claim)
+	DeleteItem(getInviteIndexTable(author), claim)
+}
+
 func ConsumeInvite(claim string) string {
+	inviteIndexOnce.Do(migrateInviteIndex)
+
 	author := string(GetItem("invite", claim))
 
 	if RELAY_CONSUME_CLAIMS && author != "" {
-		DeleteItem("invite", claim)
+		DeleteInvite(author, claim)
 	}
 
 	return author
 }
 
+func ListInvites(author string) []string {
+	inviteIndexOnce.Do(migrateInviteIndex)
+
+	claims := Keys(ListItems(getInviteIndexTable(author)))
+
+	slices.Sort(claims)
+
+	return claims
+}
+
+// GetActiveInvite returns an outstanding invite issued by author, preferring the one most
+// recently generated for them, or an empty string if they have none.
+func GetActiveInvite(author string) string {
+	inviteIndexOnce.Do(migrateInviteIndex)
+
+	claim := string(GetItem("activeinvite", author))
+
+	if claim != "" && HasItem(getInviteIndexTable(author), claim) {
+		return claim
+	}
+
+	// Otherwise fall back to the newest invite they have left
+	claim = ""
+	newest := nostr.Timestamp(0)
+	for _, c := range ListInvites(author) {
+		if ts := GetInviteCreatedAt(author, c); claim == "" || ts >= newest {
+			claim, newest = c, ts
+		}
+	}
+
+	if claim != "" {
+		PutItem("activeinvite", author, []byte(claim))
+	}
+
+	return claim
+}
+
+func GetInviteQuota(pubkey string) int {
+	if quota, err := strconv.Atoi(string(GetItem("invitequota", pubkey))); err == nil {
+		return quota
+	}
+
+	quota := -1
+	for _, claim := range GetUserClaims(pubkey) {
+		if q, err := strconv.Atoi(string(GetItem("claiminvitequota", claim))); err == nil && q > quota {
+			quota = q
+		}
+
+		if tier := GetClaimTier(claim); tier != "" {
+			if q, err := strconv.Atoi(string(GetItem("tierinvitequota", tier))); err == nil && q > quota {
+				quota = q
+			}
+		}
+	}
+
+	if quota >= 0 {
+		return quota
+	}
+
+	return RELAY_INVITE_QUOTA
+}
+
+func SetInviteQuota(pubkey string, quota int) {
+	PutItem("invitequota", pubkey, []byte(strconv.Itoa(quota)))
+}
+
+func SetClaimInviteQuota(claim string, quota int) {
+	PutItem("claiminvitequota", claim, []byte(strconv.Itoa(quota)))
+}
+
+func SetTierInviteQuota(tier string, quota int) {
+	PutItem("tierinvitequota", tier, []byte(strconv.Itoa(quota)))
+}
+
+// GetOrGenerateInvite returns the author's active invite, generating one only if they have
+// none and are still under their quota of outstanding invites.
+func GetOrGenerateInvite(author string) string {
+	if claim := GetActiveInvite(author); claim != "" {
+		return claim
+	}
+
+	if len(ListInvites(author)) >= GetInviteQuota(author) {
+		return ""
+	}
+
+	return GenerateInvite(author)
+}
+
+// RotateInvite revokes all of the author's outstanding invites and issues a new one.
+func RotateInvite(author string) string {
+	for _, claim := range ListInvites(author) {
+		DeleteInvite(author, claim)
+	}
+
+	DeleteItem("activeinvite", author)
+
+	return GetOrGenerateInvite(author)
+}
+
 func GenerateInviteEvents(ctx context.Context, filter nostr.Filter) []*nostr.Event {
 	pubkey := khatru.GetAuthed(ctx)
 
-	if pubkey == "" {
+	if pubkey == "" || !HasCapability(pubkey, CAP_INVITE) {
+		return []*nostr.Event{}
+	}
+
+	claim := GetOrGenerateInvite(pubkey)
+
+	if claim == "" {
 		return []*nostr.Event{}
 	}
 
-	claim := GenerateInvite(pubkey)
-	event := nostr.Event{
+	event := MakeInviteEvent(pubkey, claim)
+
+	if err := SignAsRelay(event); err != nil {
+		log.Println("Failed to sign invite event", err)
+
+		return []*nostr.Event{}
+	}
+
+	return []*nostr.Event{event}
+}
+
+func MakeInviteEvent(author string, claim string) *nostr.Event {
+	return &nostr.Event{
 		Kind:      AUTH_INVITE,
-		CreatedAt: nostr.Now(),
+		CreatedAt: GetInviteCreatedAt(author, claim),
 		Tags: nostr.Tags{
 			nostr.Tag{"claim", claim},
 		},
 	}
+}
+
+// Invite tree, recording which member vouched for each invitee
+
+const (
+	REVOKE_INVITEES_NONE   = "none"
+	REVOKE_INVITEES_REVOKE = "revoke"
+	REVOKE_INVITEES_FLAG   = "flag"
+)
+
+type InviteNode struct {
+	PubKey   string        `json:"pubkey"`
+	Invitees []*InviteNode `json:"invitees"`
+}
+
+func AddInvitee(inviter string, invitee string) {
+	if !HasItem("inviter", invitee) {
+		PutItem("inviter", invitee, []byte(inviter))
+	}
+}
+
+func GetInviter(invitee string) string {
+	return string(GetItem("inviter", invitee))
+}
+
+func GetInvitees(inviter string) []string {
+	invitees := make([]string, 0)
+
+	for invitee, author := range ListItems("inviter") {
+		if author == inviter {
+			invitees = append(invitees, invitee)
+		}
+	}
+
+	slices.Sort(invitees)
+
+	return invitees
+}
+
+func GetInviteTree(root string) *InviteNode {
+	return buildInviteTree(root, ListItems("inviter"), make(map[string]bool))
+}
+
+func buildInviteTree(root string, edges map[string]string, seen map[string]bool) *InviteNode {
+	var build func(pubkey string) *InviteNode
+
+	build = func(pubkey string) *InviteNode {
+		node := &InviteNode{PubKey: pubkey, Invitees: []*InviteNode{}}
+
+		// Guard against cycles, which can happen if an inviter later re-joins using an invite
+		if seen[pubkey] {
+			return node
+		}
+
+		seen[pubkey] = true
+
+		for invitee, inviter := range edges {
+			if inviter == pubkey {
+				node.Invitees = append(node.Invitees, build(invitee))
+			}
+		}
+
+		slices.SortFunc(node.Invitees, func(a, b *InviteNode) int {
+			return strings.Compare(a.PubKey, b.PubKey)
+		})
+
+		return node
+	}
+
+	return build(root)
+}
+
+// GetInviteForest returns a tree for each inviter who wasn't invited themselves. Invite cycles
+// have no such inviter, so each of them gets a tree rooted somewhere on the cycle instead.
+func GetInviteForest() []*InviteNode {
+	edges := ListItems("inviter")
+	roots := make([]string, 0)
+
+	for _, inviter := range edges {
+		if _, ok := edges[inviter]; !ok && !slices.Contains(roots, inviter) {
+			roots = append(roots, inviter)
+		}
+	}
 
-	event.Sign(RELAY_SECRET)
+	slices.Sort(roots)
+
+	seen := make(map[string]bool)
+	forest := make([]*InviteNode, 0, len(roots))
+	for _, root := range roots {
+		forest = append(forest, buildInviteTree(root, edges, seen))
+	}
 
-	return []*nostr.Event{&event}
+	invitees := Keys(edges)
+	slices.Sort(invitees)
+
+	for _, pubkey := range invitees {
+		if seen[pubkey] {
+			continue
+		}
+
+		// Anyone not reached from a root is invited from within a cycle, so follow their
+		// inviters until we come back around
+		visited := make(map[string]bool)
+		for !visited[pubkey] {
+			visited[pubkey] = true
+			pubkey = edges[pubkey]
+		}
+
+		forest = append(forest, buildInviteTree(pubkey, edges, seen))
+	}
+
+	return forest
+}
+
+func FlagPubKey(pubkey string, reason string) {
+	PutItem("flaggedpubkey", pubkey, []byte(reason))
+}
+
+func UnflagPubKey(pubkey string) {
+	DeleteItem("flaggedpubkey", pubkey)
+}
+
+func IsRevoked(pubkey string) bool {
+	return HasItem("revokedpubkey", pubkey)
+}
+
+// ReinstateAccess lifts a revocation, so that pubkey's other sources of access apply again
+func ReinstateAccess(pubkey string) {
+	DeleteItem("revokedpubkey", pubkey)
+}
+
+// RemoveAccess removes the access pubkey was granted directly, without preventing them from
+// being granted access again.
+func RemoveAccess(pubkey string) {
+	DeleteItem("claim", pubkey)
+	DeleteItem("allowedpubkey", pubkey)
+	UpdateMembership(pubkey)
+}
+
+// RevokeAccess removes all claims held by pubkey, and denies them access from every other
+// source until they're reinstated. Depending on cascade, everyone they invited is revoked
+// recursively or flagged for review.
+func RevokeAccess(pubkey string, reason string, cascade string) {
+	revoked := make(map[string]bool)
+
+	var revoke func(pubkey string, reason string)
+
+	revoke = func(pubkey string, reason string) {
+		if revoked[pubkey] {
+			return
+		}
+
+		revoked[pubkey] = true
+
+		// Removing access updates the published membership, which takes the revocation into account
+		PutItem("revokedpubkey", pubkey, []byte(reason))
+		RemoveAccess(pubkey)
+
+		for _, invitee := range GetInvitees(pubkey) {
+			switch cascade {
+			case REVOKE_INVITEES_REVOKE:
+				revokeReason := fmt.Sprintf("inviter %s was revoked", pubkey)
+				revoke(invitee, revokeReason)
+				Audit(RELAY_SELF, "revokepubkey", invitee, revokeReason)
+			case REVOKE_INVITEES_FLAG:
+				flagReason := fmt.Sprintf("inviter %s was revoked: %s", pubkey, reason)
+				FlagPubKey(invitee, flagReason)
+				Audit(RELAY_SELF, "flagpubkey", invitee, flagReason)
+			}
+		}
+	}
+
+	revoke(pubkey, reason)
 }
 
 // Access policies
 
-func HasAccess(pubkey string) bool {
-	return slices.Contains(RELAY_ADMINS, pubkey) ||
-		HasAccessUsingWhitelist(pubkey) ||
-		HasAccessUsingClaim(pubkey) ||
-		HasAccessUsingBackend(pubkey)
+const (
+	POLICY_ADMINS        = "admins"
+	POLICY_WHITELIST     = "whitelist"
+	POLICY_CLAIMS        = "claims"
+	POLICY_BACKEND       = "backend"
+	POLICY_AUTHENTICATED = "authenticated"
+	POLICY_WOT           = "wot"
+	POLICY_NIP05         = "nip05"
+)
+
+var POLICY_SOURCES = []string{POLICY_ADMINS, POLICY_WHITELIST, POLICY_CLAIMS, POLICY_BACKEND, POLICY_AUTHENTICATED, POLICY_WOT, POLICY_NIP05}
+
+// Joining is checked in addition to the capabilities, and is granted by having any access at all
+const ACTION_JOIN = "join"
+
+// AccessRequest describes an action a pubkey wants to take, along with the kind of event
+// and the group it concerns, if any.
+type AccessRequest struct {
+	PubKey string `json:"pubkey"`
+	Action string `json:"action"`
+	Kind   *int   `json:"kind,omitempty"`
+	Group  string `json:"group,omitempty"`
 }
 
-func HasAccessUsingWhitelist(pubkey string) bool {
-	return slices.Contains(RELAY_WHITELIST, pubkey)
+// HasAccess checks whether pubkey has been granted any capability at all.
+func HasAccess(pubkey string) bool {
+	return HasCapability(pubkey, ACTION_JOIN)
 }
 
-func HasAccessUsingClaim(pubkey string) bool {
-	return len(GetUserClaims(pubkey)) > 0
+// GetPolicy returns the chain of sources consulted for an action. Reading has its own
+// chain, joining may be granted by either, and everything else is governed by the write chain.
+func GetPolicy(action string) []string {
+	switch action {
+	case CAP_READ:
+		return RELAY_READ_POLICY
+	case ACTION_JOIN:
+		policy := slices.Clone(RELAY_READ_POLICY)
+		for _, source := range RELAY_WRITE_POLICY {
+			if !slices.Contains(policy, source) {
+				policy = append(policy, source)
+			}
+		}
+
+		return policy
+	}
+
+	return RELAY_WRITE_POLICY
 }
 
-type BackendAccess struct {
-	granted bool
-	expires time.Time
+// HasCapability checks whether pubkey may perform a specific action. Admins have every
+// capability, claims grant the capabilities of their tier, and every other source grants
+// DEFAULT_CAPABILITIES.
+func HasCapability(pubkey string, capability string) bool {
+	granted, _ := CheckAccess(AccessRequest{PubKey: pubkey, Action: capability})
+
+	return granted
 }
 
-var backend_acl = make(map[string]BackendAccess)
-var backend_acl_mu sync.Mutex
+// CheckAccess walks the policy chain for a request. If access is denied, the reason given
+// by the last source to provide one is returned.
+func CheckAccess(req AccessRequest) (bool, string) {
+	// Revocation overrides the whitelist, backend, and everything else except being an admin
+	if IsRevoked(req.PubKey) && !slices.Contains(RELAY_ADMINS, req.PubKey) {
+		return false, "your access has been revoked"
+	}
+
+	reason := ""
+
+	for _, source := range GetPolicy(req.Action) {
+		granted, msg := CheckAccessUsingSource(source, req)
 
-func HasAccessUsingBackend(pubkey string) bool {
-	backend_acl_mu.Lock()
-	defer backend_acl_mu.Unlock()
+		if granted {
+			return true, ""
+		}
 
-	// If we don't have a backend, we're done
-	if RELAY_AUTH_BACKEND == "" {
-		return false
+		if msg != "" {
+			reason = msg
+		}
 	}
 
-	// If we have an un-expired entry, use it
-	if access, ok := backend_acl[pubkey]; ok && access.expires.After(time.Now()) {
-		return access.granted
+	return false, reason
+}
+
+func CheckAccessUsingSource(source string, req AccessRequest) (bool, string) {
+	if source != POLICY_ADMINS && source != POLICY_CLAIMS && req.Action != ACTION_JOIN && !slices.Contains(DEFAULT_CAPABILITIES, req.Action) {
+		return false, ""
+	}
+
+	switch source {
+	case POLICY_ADMINS:
+		return slices.Contains(RELAY_ADMINS, req.PubKey), ""
+	case POLICY_WHITELIST:
+		return HasAccessUsingWhitelist(req.PubKey), ""
+	case POLICY_CLAIMS:
+		if req.Action == ACTION_JOIN {
+			return HasAccessUsingClaim(req.PubKey), ""
+		}
+
+		return HasCapabilityUsingClaim(req.PubKey, req.Action), ""
+	case POLICY_BACKEND:
+		return CheckAccessUsingBackend(req)
+	case POLICY_AUTHENTICATED:
+		return req.PubKey != "", ""
+	case POLICY_WOT:
+		return HasAccessUsingWoT(req.PubKey), ""
+	case POLICY_NIP05:
+		return HasAccessUsingNIP05(req.PubKey), ""
 	}
 
-	// Fetch the url
-	res, err := http.Get(fmt.Sprintf("%s%s", RELAY_AUTH_BACKEND, pubkey))
+	return false, ""
+}
+
+func HasAccessUsingWhitelist(pubkey string) bool {
+	return slices.Contains(RELAY_WHITELIST, pubkey) ||
+		HasAccessUsingListWhitelist(pubkey) ||
+		HasItem("allowedpubkey", pubkey)
+}
+
+func HasAccessUsingClaim(pubkey string) bool {
+	for _, claim := range GetUserClaims(pubkey) {
+		if len(GetClaimCapabilities(claim)) > 0 {
+			return true
+		}
+	}
 
-	// If we get a 200, consider it good
-	if err == nil {
-		expire_after, _ := time.ParseDuration("1m")
+	return false
+}
 
-		backend_acl[pubkey] = BackendAccess{
-			granted: res.StatusCode == 200,
-			expires: time.Now().Add(expire_after),
+func HasCapabilityUsingClaim(pubkey string, capability string) bool {
+	for _, claim := range GetUserClaims(pubkey) {
+		if slices.Contains(GetClaimCapabilities(claim), capability) {
+			return true
 		}
-	} else {
-		fmt.Println(err)
 	}
 
-	return backend_acl[pubkey].granted
+	return false
 }
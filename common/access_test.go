@@ -0,0 +1,299 @@
+package common
+
+import (
+	"net/http"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// findInviteNode returns the node for pubkey in a forest, if it's there
+func findInviteNode(nodes []*InviteNode, pubkey string) *InviteNode {
+	for _, node := range nodes {
+		if node.PubKey == pubkey {
+			return node
+		}
+
+		if found := findInviteNode(node.Invitees, pubkey); found != nil {
+			return found
+		}
+	}
+
+	return nil
+}
+
+func TestInviteForestIncludesCycles(t *testing.T) {
+	_, a := testKeypair()
+	_, b := testKeypair()
+	_, c := testKeypair()
+
+	// a invited b, who invited c, and then a re-joined using an invite from b
+	AddInvitee(a, b)
+	AddInvitee(b, c)
+	AddInvitee(b, a)
+
+	forest := GetInviteForest()
+
+	for _, pubkey := range []string{a, b, c} {
+		if findInviteNode(forest, pubkey) == nil {
+			t.Fatalf("expected %s to be in the invite forest", pubkey)
+		}
+	}
+
+	if node := findInviteNode(forest, b); len(node.Invitees) != 2 {
+		t.Fatalf("expected b's tree to include both of their invitees, got %+v", node)
+	}
+}
+
+func TestInviteMigrationPrunesOldInvites(t *testing.T) {
+	_, member := testKeypair()
+	_, organizer := testKeypair()
+
+	SetInviteQuota(organizer, 2)
+	defer DeleteItem("invitequota", organizer)
+
+	// Invites from before the index existed, oldest first
+	legacy := map[string][]string{member: {}, organizer: {}}
+	for range 3 {
+		for author := range legacy {
+			claim := RandomString(8)
+			PutItem("invite", claim, []byte(author))
+			legacy[author] = append(legacy[author], claim)
+		}
+	}
+
+	DeleteItem("migration", "inviteindex")
+	inviteIndexOnce = sync.Once{}
+
+	expected := map[string][]string{member: legacy[member][2:], organizer: legacy[organizer][1:]}
+
+	for author, claims := range expected {
+		if invites := ListInvites(author); !slices.Equal(invites, slices.Sorted(slices.Values(claims))) {
+			t.Fatalf("expected the newest invites up to the quota to be kept, got %v", invites)
+		}
+
+		if active := GetActiveInvite(author); active != claims[len(claims)-1] {
+			t.Fatalf("expected the newest invite to be active, got %s", active)
+		}
+
+		for _, claim := range legacy[author] {
+			if HasItem("invite", claim) != slices.Contains(claims, claim) {
+				t.Fatalf("expected invites over the quota to be deleted")
+			}
+		}
+	}
+
+	if GetOrGenerateInvite(member) != legacy[member][2] {
+		t.Fatalf("expected no new invite while one is outstanding")
+	}
+}
+
+func TestActiveInviteFallsBackToNewest(t *testing.T) {
+	_, author := testKeypair()
+
+	SetInviteQuota(author, 3)
+	defer DeleteItem("invitequota", author)
+
+	old := GenerateInvite(author)
+	PutItem(getInviteIndexTable(author), old, []byte("100"))
+
+	newest := GenerateInvite(author)
+	PutItem(getInviteIndexTable(author), newest, []byte("300"))
+
+	active := GenerateInvite(author)
+	PutItem(getInviteIndexTable(author), active, []byte("200"))
+
+	DeleteInvite(author, active)
+
+	if claim := GetActiveInvite(author); claim != newest {
+		t.Fatalf("expected the newest remaining invite to become active, got %s", claim)
+	}
+}
+
+func TestGetPolicy(t *testing.T) {
+	defer func(read, write []string) { RELAY_READ_POLICY, RELAY_WRITE_POLICY = read, write }(RELAY_READ_POLICY, RELAY_WRITE_POLICY)
+
+	RELAY_READ_POLICY = []string{POLICY_ADMINS, POLICY_AUTHENTICATED}
+	RELAY_WRITE_POLICY = []string{POLICY_ADMINS, POLICY_CLAIMS}
+
+	cases := map[string][]string{
+		CAP_READ:    {POLICY_ADMINS, POLICY_AUTHENTICATED},
+		CAP_WRITE:   {POLICY_ADMINS, POLICY_CLAIMS},
+		CAP_UPLOAD:  {POLICY_ADMINS, POLICY_CLAIMS},
+		CAP_GROUPS:  {POLICY_ADMINS, POLICY_CLAIMS},
+		CAP_INVITE:  {POLICY_ADMINS, POLICY_CLAIMS},
+		ACTION_JOIN: {POLICY_ADMINS, POLICY_AUTHENTICATED, POLICY_CLAIMS},
+	}
+
+	for action, expected := range cases {
+		if actual := GetPolicy(action); !slices.Equal(actual, expected) {
+			t.Errorf("GetPolicy(%s) = %v, expected %v", action, actual, expected)
+		}
+	}
+}
+
+func TestSeparateReadAndWritePolicies(t *testing.T) {
+	defer func(read, write []string) { RELAY_READ_POLICY, RELAY_WRITE_POLICY = read, write }(RELAY_READ_POLICY, RELAY_WRITE_POLICY)
+
+	RELAY_READ_POLICY = []string{POLICY_ADMINS, POLICY_AUTHENTICATED}
+	RELAY_WRITE_POLICY = []string{POLICY_ADMINS, POLICY_CLAIMS}
+
+	_, reader := testKeypair()
+	_, member := testKeypair()
+
+	defer func(claims []string) { RELAY_CLAIMS = claims }(RELAY_CLAIMS)
+	RELAY_CLAIMS = []string{"member"}
+
+	AddUserClaim(member, "member")
+	defer RemoveAccess(member)
+
+	cases := []struct {
+		pubkey   string
+		action   string
+		expected bool
+	}{
+		{reader, CAP_READ, true},
+		{reader, CAP_WRITE, false},
+		{reader, ACTION_JOIN, true},
+		{member, CAP_READ, true},
+		{member, CAP_WRITE, true},
+		{testAdmin, CAP_WRITE, true},
+		{"", CAP_READ, false},
+	}
+
+	for _, c := range cases {
+		if actual := HasCapability(c.pubkey, c.action); actual != c.expected {
+			t.Errorf("HasCapability(%s, %s) = %v, expected %v", c.pubkey, c.action, actual, c.expected)
+		}
+	}
+}
+
+func TestRevocationOverridesOtherSources(t *testing.T) {
+	defer func(read, write []string) { RELAY_READ_POLICY, RELAY_WRITE_POLICY = read, write }(RELAY_READ_POLICY, RELAY_WRITE_POLICY)
+	defer func(whitelist []string) { RELAY_WHITELIST = whitelist }(RELAY_WHITELIST)
+	defer func(contacts bool) { RELAY_WHITELIST_CONTACTS = contacts }(RELAY_WHITELIST_CONTACTS)
+
+	useTestBackend(t, "1", func(w http.ResponseWriter, r *http.Request) {})
+
+	cases := []struct {
+		source  string
+		grant   func(pubkey string)
+		revoked bool
+	}{
+		{POLICY_WHITELIST, func(pubkey string) { RELAY_WHITELIST = []string{pubkey} }, true},
+		{POLICY_WHITELIST, func(pubkey string) {
+			RELAY_WHITELIST_CONTACTS = true
+			saveContactList(t, testAdminSecret, pubkey)
+			RefreshListWhitelist()
+		}, true},
+		{POLICY_BACKEND, func(pubkey string) {}, true},
+		{POLICY_AUTHENTICATED, func(pubkey string) {}, true},
+		{POLICY_ADMINS, func(pubkey string) {}, false},
+	}
+
+	for _, c := range cases {
+		RELAY_READ_POLICY = []string{c.source}
+		RELAY_WRITE_POLICY = []string{c.source}
+
+		_, pubkey := testKeypair()
+		if c.source == POLICY_ADMINS {
+			pubkey = testAdmin
+		}
+
+		c.grant(pubkey)
+
+		if !HasCapability(pubkey, CAP_WRITE) {
+			t.Fatalf("expected %s to grant access", c.source)
+		}
+
+		RevokeAccess(pubkey, "spam", REVOKE_INVITEES_NONE)
+
+		granted, reason := CheckAccess(AccessRequest{PubKey: pubkey, Action: CAP_WRITE})
+		if c.revoked && (granted || reason != "your access has been revoked") {
+			t.Errorf("expected revocation to override %s, got %v %q", c.source, granted, reason)
+		} else if !c.revoked && !granted {
+			t.Errorf("expected revocation not to override %s", c.source)
+		}
+
+		ReinstateAccess(pubkey)
+
+		if c.revoked && !HasCapability(pubkey, CAP_WRITE) {
+			t.Errorf("expected reinstating to restore access from %s", c.source)
+		}
+	}
+
+	RELAY_WHITELIST_CONTACTS = false
+	RefreshListWhitelist()
+}
+
+func TestTierCapabilities(t *testing.T) {
+	defer func(claims []string) { RELAY_CLAIMS = claims }(RELAY_CLAIMS)
+	defer func(tiers map[string]string) { RELAY_CLAIM_TIERS = tiers }(RELAY_CLAIM_TIERS)
+	defer func(tiers map[string][]string) { RELAY_TIERS = tiers }(RELAY_TIERS)
+	defer func(tier string) { RELAY_INVITE_TIER = tier }(RELAY_INVITE_TIER)
+	defer func(tier string) { RELAY_PAYMENT_TIER = tier }(RELAY_PAYMENT_TIER)
+	defer func(tier string) { RELAY_APPLICATION_TIER = tier }(RELAY_APPLICATION_TIER)
+
+	RELAY_CLAIMS = []string{"lurk", "organize", "plain"}
+	RELAY_CLAIM_TIERS = map[string]string{"lurk": "lurker", "organize": "organizer"}
+	RELAY_TIERS = map[string][]string{
+		"lurker":    {CAP_READ},
+		"member":    {CAP_READ, CAP_WRITE},
+		"organizer": {CAP_READ, CAP_WRITE, CAP_GROUPS},
+	}
+	RELAY_INVITE_TIER = "member"
+	RELAY_PAYMENT_TIER = "organizer"
+	RELAY_APPLICATION_TIER = ""
+
+	cases := []struct {
+		claim    string
+		tier     string
+		expected []string
+	}{
+		{"lurk", "lurker", []string{CAP_READ}},
+		{"organize", "organizer", []string{CAP_READ, CAP_WRITE, CAP_GROUPS}},
+		{"plain", "", DEFAULT_CAPABILITIES},
+		{PAID_CLAIM, "organizer", []string{CAP_READ, CAP_WRITE, CAP_GROUPS}},
+		{APPLICATION_CLAIM, "", DEFAULT_CAPABILITIES},
+		{"someinvite", "member", []string{CAP_READ, CAP_WRITE}},
+	}
+
+	for _, c := range cases {
+		if tier := GetClaimTier(c.claim); tier != c.tier {
+			t.Errorf("GetClaimTier(%s) = %q, expected %q", c.claim, tier, c.tier)
+		}
+
+		if capabilities := GetClaimCapabilities(c.claim); !slices.Equal(capabilities, c.expected) {
+			t.Errorf("GetClaimCapabilities(%s) = %v, expected %v", c.claim, capabilities, c.expected)
+		}
+
+		_, pubkey := testKeypair()
+		AddUserClaim(pubkey, c.claim)
+
+		for _, capability := range CAPABILITIES {
+			if granted := HasCapabilityUsingClaim(pubkey, capability); granted != slices.Contains(c.expected, capability) {
+				t.Errorf("HasCapabilityUsingClaim(%s) with claim %s = %v", capability, c.claim, granted)
+			}
+		}
+
+		RemoveAccess(pubkey)
+	}
+
+	// Capabilities from several claims add up, and expired claims grant nothing
+	_, pubkey := testKeypair()
+	AddUserClaim(pubkey, "lurk")
+	PutUserClaimRecords(pubkey, append(GetUserClaimRecords(pubkey), UserClaim{Claim: "organize", Expires: nostr.Now() - 1}))
+	defer RemoveAccess(pubkey)
+
+	if !HasCapabilityUsingClaim(pubkey, CAP_READ) || HasCapabilityUsingClaim(pubkey, CAP_GROUPS) {
+		t.Fatalf("expected an expired claim's tier not to apply")
+	}
+
+	GrantUserClaim(pubkey, "organize", 0)
+
+	if !HasCapabilityUsingClaim(pubkey, CAP_GROUPS) {
+		t.Fatalf("expected a renewed claim's tier to apply")
+	}
+}
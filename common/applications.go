@@ -0,0 +1,131 @@
+package common
+
+import (
+	"encoding/json"
+	"log"
+	"slices"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Membership applications, queued when someone asks to join without a valid claim and
+// reviewed by admins. Approved applicants are granted APPLICATION_CLAIM.
+
+const APPLICATION_CLAIM = "approved"
+
+// Messages longer than this are truncated
+const APPLICATION_MAX_MESSAGE = 2000
+
+const (
+	APPLICATION_PENDING = "pending"
+	APPLICATION_DENIED  = "denied"
+)
+
+type Application struct {
+	PubKey    string          `json:"pubkey"`
+	Message   string          `json:"message"`
+	Status    string          `json:"status"`
+	Reason    string          `json:"reason,omitempty"`
+	CreatedAt nostr.Timestamp `json:"created_at"`
+}
+
+func GetApplication(pubkey string) *Application {
+	var application Application
+
+	if err := json.Unmarshal(GetItem("application", pubkey), &application); err != nil {
+		return nil
+	}
+
+	return &application
+}
+
+func PutApplication(application Application) {
+	data, err := json.Marshal(application)
+	if err != nil {
+		log.Println(err)
+	} else {
+		PutItem("application", application.PubKey, data)
+	}
+}
+
+func ListApplications(status string) []Application {
+	applications := make([]Application, 0)
+
+	for _, item := range ListItems("application") {
+		var application Application
+
+		if err := json.Unmarshal([]byte(item), &application); err != nil {
+			log.Printf("Failed to unmarshal application %v %s", err, item)
+			continue
+		}
+
+		if status == "" || application.Status == status {
+			applications = append(applications, application)
+		}
+	}
+
+	slices.SortFunc(applications, func(a, b Application) int {
+		return int(a.CreatedAt - b.CreatedAt)
+	})
+
+	return applications
+}
+
+// SubmitApplication queues an application for review, and returns a message describing its
+// status for the applicant. Denied applicants can't re-apply until an admin approves them.
+// Re-submitting updates the message, but keeps the application's place in the queue.
+func SubmitApplication(pubkey string, message string) string {
+	if IsBanned(pubkey) {
+		return "restricted: you have been banned from this relay"
+	}
+
+	application := GetApplication(pubkey)
+
+	if application != nil && application.Status == APPLICATION_DENIED {
+		if application.Reason != "" {
+			return "restricted: your application was denied: " + application.Reason
+		}
+
+		return "restricted: your application was denied"
+	}
+
+	if len(message) > APPLICATION_MAX_MESSAGE {
+		message = strings.ToValidUTF8(message[:APPLICATION_MAX_MESSAGE], "")
+	}
+
+	createdAt := nostr.Now()
+	if application != nil {
+		createdAt = application.CreatedAt
+	}
+
+	PutApplication(Application{
+		PubKey:    pubkey,
+		Message:   message,
+		Status:    APPLICATION_PENDING,
+		CreatedAt: createdAt,
+	})
+
+	return "restricted: your application is pending review"
+}
+
+func ApproveApplication(pubkey string) {
+	DeleteItem("application", pubkey)
+	ReinstateAccess(pubkey)
+	AddUserClaim(pubkey, APPLICATION_CLAIM)
+	UpdateMembership(pubkey)
+}
+
+func DenyApplication(pubkey string, reason string) bool {
+	application := GetApplication(pubkey)
+	if application == nil {
+		return false
+	}
+
+	application.Status = APPLICATION_DENIED
+	application.Reason = reason
+
+	PutApplication(*application)
+
+	return true
+}
@@ -0,0 +1,37 @@
+package common
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSubmitApplication(t *testing.T) {
+	_, applicant := testKeypair()
+	_, banned := testKeypair()
+
+	SubmitApplication(applicant, "hello")
+
+	application := GetApplication(applicant)
+	if application == nil || application.Status != APPLICATION_PENDING {
+		t.Fatalf("expected a pending application, got %+v", application)
+	}
+
+	// Re-applying updates the message, but not the application's place in the queue
+	application.CreatedAt -= 3600
+	PutApplication(*application)
+
+	SubmitApplication(applicant, strings.Repeat("a", APPLICATION_MAX_MESSAGE+1))
+
+	if updated := GetApplication(applicant); updated.CreatedAt != application.CreatedAt {
+		t.Fatalf("expected re-applying to keep the original timestamp")
+	} else if len(updated.Message) != APPLICATION_MAX_MESSAGE {
+		t.Fatalf("expected the message to be cut off at %d bytes, got %d", APPLICATION_MAX_MESSAGE, len(updated.Message))
+	}
+
+	BanPubKey(banned, "spam", 0, PURGE_NONE)
+	defer UnbanPubKey(banned)
+
+	if msg := SubmitApplication(banned, "let me in"); !strings.Contains(msg, "banned") || GetApplication(banned) != nil {
+		t.Fatalf("expected banned pubkeys not to be able to apply, got %q", msg)
+	}
+}
@@ -0,0 +1,143 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// An append-only record of administrative actions and access changes. Actions taken by the
+// relay itself, such as expiring claims, are attributed to RELAY_SELF.
+
+type AuditEntry struct {
+	ID        string          `json:"id"`
+	Actor     string          `json:"actor"`
+	Action    string          `json:"action"`
+	Target    string          `json:"target,omitempty"`
+	Reason    string          `json:"reason,omitempty"`
+	Details   any             `json:"details,omitempty"`
+	CreatedAt nostr.Timestamp `json:"created_at"`
+}
+
+type AuditFilter struct {
+	Actor  string          `json:"actor,omitempty"`
+	Action string          `json:"action,omitempty"`
+	Target string          `json:"target,omitempty"`
+	Since  nostr.Timestamp `json:"since,omitempty"`
+	Until  nostr.Timestamp `json:"until,omitempty"`
+	Limit  int             `json:"limit,omitempty"`
+}
+
+// The most entries the listauditlog NIP 86 method returns at once
+const AUDIT_LOG_LIMIT = 1000
+
+func (f AuditFilter) Matches(entry AuditEntry) bool {
+	if f.Actor != "" && f.Actor != entry.Actor {
+		return false
+	}
+
+	if f.Action != "" && f.Action != entry.Action {
+		return false
+	}
+
+	if f.Target != "" && f.Target != entry.Target {
+		return false
+	}
+
+	if f.Since != 0 && entry.CreatedAt < f.Since {
+		return false
+	}
+
+	if f.Until != 0 && entry.CreatedAt > f.Until {
+		return false
+	}
+
+	return true
+}
+
+var GROUP_MODERATION_ACTIONS = map[int]string{
+	nostr.KindSimpleGroupPutUser:      "putuser",
+	nostr.KindSimpleGroupRemoveUser:   "removeuser",
+	nostr.KindSimpleGroupEditMetadata: "editmetadata",
+	nostr.KindSimpleGroupDeleteEvent:  "deleteevent",
+	nostr.KindSimpleGroupCreateGroup:  "creategroup",
+	nostr.KindSimpleGroupDeleteGroup:  "deletegroup",
+	nostr.KindSimpleGroupCreateInvite: "createinvite",
+}
+
+func AuditGroupModeration(event *nostr.Event) {
+	action, ok := GROUP_MODERATION_ACTIONS[event.Kind]
+	if !ok {
+		return
+	}
+
+	details := map[string]any{"event": event.ID}
+
+	for _, key := range []string{"p", "e"} {
+		values := make([]string, 0)
+		for tag := range event.Tags.FindAll(key) {
+			values = append(values, tag[1])
+		}
+
+		if len(values) > 0 {
+			details[key] = values
+		}
+	}
+
+	AuditWithDetails(event.PubKey, action, GetGroupIDFromEvent(event), event.Content, details)
+}
+
+func Audit(actor string, action string, target string, reason string) {
+	AuditWithDetails(actor, action, target, reason, nil)
+}
+
+func AuditWithDetails(actor string, action string, target string, reason string, details any) {
+	now := time.Now()
+	entry := AuditEntry{
+		// Prefix with the time so entries sort in the order they were recorded
+		ID:        fmt.Sprintf("%019d-%s", now.UnixNano(), RandomString(4)),
+		Actor:     actor,
+		Action:    action,
+		Target:    target,
+		Reason:    reason,
+		Details:   details,
+		CreatedAt: nostr.Timestamp(now.Unix()),
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		log.Println(err)
+	} else {
+		PutItem("audit", entry.ID, data)
+	}
+}
+
+// QueryAuditLog returns matching entries, newest first. Entries are keyed by when they were
+// recorded, so the log is read backwards until the limit or the start of the filter is reached.
+func QueryAuditLog(filter AuditFilter) []AuditEntry {
+	entries := make([]AuditEntry, 0)
+
+	ScanItems("audit", true, func(key string, value []byte) bool {
+		var entry AuditEntry
+
+		if err := json.Unmarshal(value, &entry); err != nil {
+			log.Printf("Failed to unmarshal audit entry %v %s", err, value)
+			return true
+		}
+
+		if filter.Since != 0 && entry.CreatedAt < filter.Since {
+			return false
+		}
+
+		if filter.Matches(entry) {
+			entries = append(entries, entry)
+		}
+
+		return filter.Limit <= 0 || len(entries) < filter.Limit
+	})
+
+	return entries
+}
@@ -0,0 +1,80 @@
+package common
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestQueryAuditLog(t *testing.T) {
+	_, actor := testKeypair()
+
+	for i := range 5 {
+		Audit(actor, "test", "", fmt.Sprint(i))
+	}
+
+	entries := QueryAuditLog(AuditFilter{Actor: actor})
+	if len(entries) != 5 {
+		t.Fatalf("expected every entry, got %d", len(entries))
+	}
+
+	for i, entry := range entries {
+		if expected := fmt.Sprint(4 - i); entry.Reason != expected {
+			t.Fatalf("expected entries newest first, got %q at %d", entry.Reason, i)
+		}
+	}
+
+	entries = QueryAuditLog(AuditFilter{Actor: actor, Limit: 2})
+	if len(entries) != 2 || entries[0].Reason != "4" || entries[1].Reason != "3" {
+		t.Fatalf("expected the two newest entries, got %v", entries)
+	}
+
+	if entries := QueryAuditLog(AuditFilter{Actor: actor, Since: nostr.Now() + 60}); len(entries) != 0 {
+		t.Fatalf("expected no entries after since, got %d", len(entries))
+	}
+
+	if entries := QueryAuditLog(AuditFilter{Actor: actor, Until: nostr.Now() - 60}); len(entries) != 0 {
+		t.Fatalf("expected no entries before until, got %d", len(entries))
+	}
+}
+
+func TestScanItems(t *testing.T) {
+	tbl := "test-" + RandomString(4)
+
+	for _, key := range []string{"b", "a", "c"} {
+		PutItem(tbl, key, []byte(key))
+	}
+
+	// A neighbouring table that sorts after this one mustn't be included
+	PutItem(tbl+"x", "z", []byte("z"))
+
+	scan := func(reverse bool, limit int) string {
+		keys := ""
+
+		ScanItems(tbl, reverse, func(key string, value []byte) bool {
+			keys += string(value)
+
+			return len(keys) < limit
+		})
+
+		return keys
+	}
+
+	cases := []struct {
+		reverse  bool
+		limit    int
+		expected string
+	}{
+		{false, 10, "abc"},
+		{true, 10, "cba"},
+		{true, 2, "cb"},
+		{false, 1, "a"},
+	}
+
+	for _, c := range cases {
+		if keys := scan(c.reverse, c.limit); keys != c.expected {
+			t.Errorf("ScanItems(reverse=%v, limit=%d) = %s, expected %s", c.reverse, c.limit, keys, c.expected)
+		}
+	}
+}
@@ -0,0 +1,304 @@
+package common
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Access delegated to RELAY_AUTH_BACKEND. Lookups are deduplicated, cached with separate
+// lifetimes for allows and denies, and served stale while being refreshed. A circuit
+// breaker stops us from hammering a backend that keeps failing.
+
+const KindHTTPAuth = 27235
+
+// The reason given when the backend can't be reached and nothing is known about a request
+const BACKEND_UNAVAILABLE = "auth backend unavailable"
+
+type BackendAccess struct {
+	key     string
+	granted bool
+	reason  string
+	expires time.Time
+}
+
+// BackendResponse is the body returned by a version 2 auth backend
+type BackendResponse struct {
+	Allow        bool     `json:"allow"`
+	Reason       string   `json:"reason"`
+	TTL          int      `json:"ttl"`
+	Capabilities []string `json:"capabilities"`
+}
+
+type backendCall struct {
+	done    chan struct{}
+	granted bool
+	reason  string
+}
+
+var (
+	backend_acl        = make(map[string]*list.Element)
+	backend_lru        = list.New()
+	backend_calls      = make(map[string]*backendCall)
+	backend_failures   int
+	backend_open_until time.Time
+	backend_acl_mu     sync.Mutex
+)
+
+func HasAccessUsingBackend(pubkey string) bool {
+	granted, _ := CheckAccessUsingBackend(AccessRequest{PubKey: pubkey, Action: ACTION_JOIN})
+
+	return granted
+}
+
+func CheckAccessUsingBackend(req AccessRequest) (bool, string) {
+	// If we don't have a backend, we're done
+	if RELAY_AUTH_BACKEND == "" {
+		return false, ""
+	}
+
+	key := getBackendKey(req)
+	access, ok := getBackendAccess(key)
+
+	// If we have an un-expired entry, use it
+	if ok && access.expires.After(time.Now()) {
+		return access.granted, access.reason
+	}
+
+	// If we have an expired entry, use it while refreshing in the background
+	if ok {
+		go fetchBackendAccess(key, req)
+
+		return access.granted, access.reason
+	}
+
+	return fetchBackendAccess(key, req)
+}
+
+// getBackendKey identifies cache entries. The legacy protocol only ever sees the pubkey,
+// while version 2 answers may depend on the full request.
+func getBackendKey(req AccessRequest) string {
+	if RELAY_AUTH_BACKEND_VERSION != "2" {
+		return req.PubKey
+	}
+
+	kind := ""
+	if req.Kind != nil {
+		kind = fmt.Sprint(*req.Kind)
+	}
+
+	return fmt.Sprintf("%s:%s:%s:%s", req.PubKey, req.Action, kind, req.Group)
+}
+
+func getBackendAccess(key string) (BackendAccess, bool) {
+	backend_acl_mu.Lock()
+	defer backend_acl_mu.Unlock()
+
+	if el, ok := backend_acl[key]; ok {
+		backend_lru.MoveToFront(el)
+
+		return el.Value.(BackendAccess), true
+	}
+
+	return BackendAccess{}, false
+}
+
+// putBackendAccess must be called with backend_acl_mu held
+func putBackendAccess(access BackendAccess) {
+	if el, ok := backend_acl[access.key]; ok {
+		el.Value = access
+		backend_lru.MoveToFront(el)
+	} else {
+		backend_acl[access.key] = backend_lru.PushFront(access)
+	}
+
+	for backend_lru.Len() > RELAY_AUTH_BACKEND_CACHE_SIZE {
+		el := backend_lru.Back()
+		backend_lru.Remove(el)
+		delete(backend_acl, el.Value.(BackendAccess).key)
+	}
+}
+
+// fetchBackendAccess asks the backend about a request. Concurrent callers for the same key
+// share a single request.
+func fetchBackendAccess(key string, req AccessRequest) (bool, string) {
+	backend_acl_mu.Lock()
+
+	if call, ok := backend_calls[key]; ok {
+		backend_acl_mu.Unlock()
+		<-call.done
+
+		return call.granted, call.reason
+	}
+
+	// If the circuit is open, don't bother the backend
+	if time.Now().Before(backend_open_until) {
+		backend_acl_mu.Unlock()
+
+		return false, BACKEND_UNAVAILABLE
+	}
+
+	call := &backendCall{done: make(chan struct{})}
+	backend_calls[key] = call
+	backend_acl_mu.Unlock()
+
+	access, err := requestBackendAccess(req)
+	access.key = key
+
+	backend_acl_mu.Lock()
+	delete(backend_calls, key)
+
+	if err != nil {
+		log.Println(err)
+
+		backend_failures++
+		if backend_failures >= RELAY_AUTH_BACKEND_MAX_FAILURES {
+			log.Printf("Auth backend failed %d times, pausing requests for %s", backend_failures, RELAY_AUTH_BACKEND_COOLDOWN)
+			backend_open_until = time.Now().Add(RELAY_AUTH_BACKEND_COOLDOWN)
+			backend_failures = 0
+		}
+
+		// Fall back to whatever we knew before
+		if el, ok := backend_acl[key]; ok {
+			access = el.Value.(BackendAccess)
+		} else {
+			access = BackendAccess{reason: BACKEND_UNAVAILABLE}
+		}
+	} else {
+		backend_failures = 0
+		putBackendAccess(access)
+	}
+
+	call.granted = access.granted
+	call.reason = access.reason
+	backend_acl_mu.Unlock()
+	close(call.done)
+
+	return access.granted, access.reason
+}
+
+func requestBackendAccess(req AccessRequest) (BackendAccess, error) {
+	if RELAY_AUTH_BACKEND_VERSION == "2" {
+		return requestBackendAccessV2(req)
+	}
+
+	client := &http.Client{Timeout: RELAY_AUTH_BACKEND_TIMEOUT}
+
+	// Fetch the url
+	res, err := client.Get(fmt.Sprintf("%s%s", RELAY_AUTH_BACKEND, req.PubKey))
+	if err != nil {
+		return BackendAccess{}, err
+	}
+
+	defer res.Body.Close()
+
+	// Server errors mean the backend is struggling, not that access was denied
+	if res.StatusCode >= 500 {
+		return BackendAccess{}, fmt.Errorf("auth backend responded with status %d", res.StatusCode)
+	}
+
+	// If we get a 200, consider it good
+	return makeBackendAccess(res.StatusCode == 200, "", 0), nil
+}
+
+// requestBackendAccessV2 POSTs the request as JSON, authenticated NIP 98 style with the relay's
+// key, and expects a BackendResponse in return.
+func requestBackendAccessV2(req AccessRequest) (BackendAccess, error) {
+	client := &http.Client{Timeout: RELAY_AUTH_BACKEND_TIMEOUT}
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return BackendAccess{}, err
+	}
+
+	httpReq, err := http.NewRequest("POST", RELAY_AUTH_BACKEND, bytes.NewReader(body))
+	if err != nil {
+		return BackendAccess{}, err
+	}
+
+	auth, err := makeHTTPAuthHeader(RELAY_AUTH_BACKEND, "POST", body)
+	if err != nil {
+		return BackendAccess{}, err
+	}
+
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Authorization", auth)
+
+	res, err := client.Do(httpReq)
+	if err != nil {
+		return BackendAccess{}, err
+	}
+
+	defer res.Body.Close()
+
+	// Server errors mean the backend is struggling, not that access was denied
+	if res.StatusCode >= 500 {
+		return BackendAccess{}, fmt.Errorf("auth backend responded with status %d", res.StatusCode)
+	}
+
+	if res.StatusCode != 200 {
+		return makeBackendAccess(false, "", 0), nil
+	}
+
+	var answer BackendResponse
+	if err := json.NewDecoder(res.Body).Decode(&answer); err != nil {
+		return BackendAccess{}, fmt.Errorf("invalid auth backend response: %w", err)
+	}
+
+	// If capabilities were granted, the action must be among them
+	granted := answer.Allow
+	if granted && len(answer.Capabilities) > 0 && req.Action != ACTION_JOIN {
+		granted = slices.Contains(answer.Capabilities, req.Action)
+	}
+
+	return makeBackendAccess(granted, answer.Reason, time.Duration(answer.TTL)*time.Second), nil
+}
+
+func makeBackendAccess(granted bool, reason string, ttl time.Duration) BackendAccess {
+	if ttl <= 0 && granted {
+		ttl = RELAY_AUTH_BACKEND_ALLOW_TTL
+	} else if ttl <= 0 {
+		ttl = RELAY_AUTH_BACKEND_DENY_TTL
+	}
+
+	return BackendAccess{
+		granted: granted,
+		reason:  reason,
+		expires: time.Now().Add(ttl),
+	}
+}
+
+func makeHTTPAuthHeader(url string, method string, body []byte) (string, error) {
+	hash := sha256.Sum256(body)
+	event := nostr.Event{
+		Kind:      KindHTTPAuth,
+		CreatedAt: nostr.Now(),
+		Tags: nostr.Tags{
+			nostr.Tag{"u", url},
+			nostr.Tag{"method", method},
+			nostr.Tag{"payload", hex.EncodeToString(hash[:])},
+		},
+	}
+
+	if err := SignAsRelay(&event); err != nil {
+		return "", fmt.Errorf("failed to sign auth backend request: %w", err)
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		return "", err
+	}
+
+	return "Nostr " + base64.StdEncoding.EncodeToString(data), nil
+}
@@ -0,0 +1,241 @@
+package common
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// useTestBackend points RELAY_AUTH_BACKEND at handler with an empty cache, and returns a count
+// of the requests it receives
+func useTestBackend(t *testing.T, version string, handler http.HandlerFunc) (*httptest.Server, *atomic.Int32) {
+	requests := &atomic.Int32{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		handler(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	reset := func() {
+		backend_acl_mu.Lock()
+		defer backend_acl_mu.Unlock()
+
+		backend_acl = make(map[string]*list.Element)
+		backend_lru = list.New()
+		backend_calls = make(map[string]*backendCall)
+		backend_failures = 0
+		backend_open_until = time.Time{}
+	}
+
+	backend, backendVersion := RELAY_AUTH_BACKEND, RELAY_AUTH_BACKEND_VERSION
+	t.Cleanup(func() {
+		RELAY_AUTH_BACKEND, RELAY_AUTH_BACKEND_VERSION = backend, backendVersion
+		reset()
+	})
+
+	RELAY_AUTH_BACKEND = server.URL + "/"
+	RELAY_AUTH_BACKEND_VERSION = version
+	reset()
+
+	return server, requests
+}
+
+func TestBackendDeduplicatesRequests(t *testing.T) {
+	_, requests := useTestBackend(t, "1", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+	})
+
+	_, pubkey := testKeypair()
+
+	var wg sync.WaitGroup
+	var granted atomic.Int32
+
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			if HasAccessUsingBackend(pubkey) {
+				granted.Add(1)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if n := requests.Load(); n != 1 {
+		t.Fatalf("expected concurrent checks to share a request, got %d requests", n)
+	}
+
+	if granted.Load() != 10 {
+		t.Fatalf("expected every check to get the shared answer")
+	}
+
+	HasAccessUsingBackend(pubkey)
+
+	if n := requests.Load(); n != 1 {
+		t.Fatalf("expected the answer to be cached, got %d requests", n)
+	}
+}
+
+func TestBackendServesStaleAnswers(t *testing.T) {
+	var deny atomic.Bool
+
+	_, requests := useTestBackend(t, "1", func(w http.ResponseWriter, r *http.Request) {
+		if deny.Load() {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	})
+
+	defer func(ttl time.Duration) { RELAY_AUTH_BACKEND_ALLOW_TTL = ttl }(RELAY_AUTH_BACKEND_ALLOW_TTL)
+	RELAY_AUTH_BACKEND_ALLOW_TTL = 10 * time.Millisecond
+
+	_, pubkey := testKeypair()
+
+	if !HasAccessUsingBackend(pubkey) {
+		t.Fatalf("expected access to be granted")
+	}
+
+	deny.Store(true)
+	time.Sleep(20 * time.Millisecond)
+
+	// The expired answer is used while a fresh one is fetched
+	if !HasAccessUsingBackend(pubkey) {
+		t.Fatalf("expected the stale answer to be served")
+	}
+
+	for range 100 {
+		if !HasAccessUsingBackend(pubkey) {
+			break
+		}
+
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if HasAccessUsingBackend(pubkey) {
+		t.Fatalf("expected the answer to be refreshed in the background")
+	}
+
+	if n := requests.Load(); n != 2 {
+		t.Fatalf("expected a single refresh, got %d requests", n)
+	}
+}
+
+func TestBackendEvictsLeastRecentlyUsed(t *testing.T) {
+	useTestBackend(t, "1", func(w http.ResponseWriter, r *http.Request) {})
+
+	defer func(size int) { RELAY_AUTH_BACKEND_CACHE_SIZE = size }(RELAY_AUTH_BACKEND_CACHE_SIZE)
+	RELAY_AUTH_BACKEND_CACHE_SIZE = 2
+
+	_, a := testKeypair()
+	_, b := testKeypair()
+	_, c := testKeypair()
+
+	HasAccessUsingBackend(a)
+	HasAccessUsingBackend(b)
+	HasAccessUsingBackend(a)
+	HasAccessUsingBackend(c)
+
+	for pubkey, cached := range map[string]bool{a: true, b: false, c: true} {
+		if _, ok := getBackendAccess(pubkey); ok != cached {
+			t.Fatalf("expected cached to be %v for %s", cached, pubkey)
+		}
+	}
+}
+
+func TestBackendCircuitBreaker(t *testing.T) {
+	_, requests := useTestBackend(t, "1", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+
+	defer func(n int) { RELAY_AUTH_BACKEND_MAX_FAILURES = n }(RELAY_AUTH_BACKEND_MAX_FAILURES)
+	RELAY_AUTH_BACKEND_MAX_FAILURES = 2
+
+	for range 2 {
+		_, pubkey := testKeypair()
+
+		if granted, reason := CheckAccessUsingBackend(AccessRequest{PubKey: pubkey, Action: ACTION_JOIN}); granted || reason != BACKEND_UNAVAILABLE {
+			t.Fatalf("expected failures to deny access with a reason, got %v %q", granted, reason)
+		}
+	}
+
+	// Once the circuit is open, the backend isn't asked at all
+	_, pubkey := testKeypair()
+
+	if granted, reason := CheckAccessUsingBackend(AccessRequest{PubKey: pubkey, Action: ACTION_JOIN}); granted || reason != BACKEND_UNAVAILABLE {
+		t.Fatalf("expected an open circuit to deny access with a reason, got %v %q", granted, reason)
+	}
+
+	if n := requests.Load(); n != 2 {
+		t.Fatalf("expected the circuit to stop requests, got %d requests", n)
+	}
+}
+
+func TestBackendV2Protocol(t *testing.T) {
+	var server *httptest.Server
+
+	server, requests := useTestBackend(t, "2", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		var req AccessRequest
+		if r.Method != "POST" || json.Unmarshal(body, &req) != nil {
+			t.Errorf("expected a JSON POST, got %s %s", r.Method, body)
+		}
+
+		data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(r.Header.Get("Authorization"), "Nostr "))
+		if err != nil {
+			t.Errorf("invalid authorization header: %v", err)
+		}
+
+		var auth nostr.Event
+		if err := json.Unmarshal(data, &auth); err != nil {
+			t.Errorf("invalid auth event: %v", err)
+		}
+
+		hash := sha256.Sum256(body)
+
+		if ok, _ := auth.CheckSignature(); !ok || auth.Kind != KindHTTPAuth || auth.PubKey != RELAY_SELF {
+			t.Errorf("expected a kind %d event signed by the relay, got %v", KindHTTPAuth, auth)
+		}
+
+		for tag, value := range map[string]string{"u": server.URL + "/", "method": "POST", "payload": hex.EncodeToString(hash[:])} {
+			if auth.Tags.GetFirst([]string{tag, value}) == nil {
+				t.Errorf("expected a %s tag of %s", tag, value)
+			}
+		}
+
+		json.NewEncoder(w).Encode(BackendResponse{Allow: true, Reason: "ok", Capabilities: []string{CAP_READ}})
+	})
+
+	_, pubkey := testKeypair()
+
+	for action, expected := range map[string]bool{CAP_READ: true, CAP_WRITE: false, ACTION_JOIN: true} {
+		if granted, _ := CheckAccessUsingBackend(AccessRequest{PubKey: pubkey, Action: action}); granted != expected {
+			t.Fatalf("expected %s to be %v", action, expected)
+		}
+	}
+
+	// Each kind of request is cached separately
+	if n := requests.Load(); n != 3 {
+		t.Fatalf("expected a request per action, got %d requests", n)
+	}
+
+	CheckAccessUsingBackend(AccessRequest{PubKey: pubkey, Action: CAP_READ})
+
+	if n := requests.Load(); n != 3 {
+		t.Fatalf("expected answers to be cached, got %d requests", n)
+	}
+}
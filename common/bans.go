@@ -0,0 +1,173 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Pubkey bans, which may be temporary. Bans are stored as JSON, although older entries may
+// consist of just the reason.
+
+type Ban struct {
+	Reason    string          `json:"reason"`
+	Expires   nostr.Timestamp `json:"expires,omitempty"`
+	Purge     string          `json:"purge,omitempty"`
+	CreatedAt nostr.Timestamp `json:"created_at,omitempty"`
+}
+
+func (b Ban) IsExpired() bool {
+	return b.Expires != 0 && b.Expires <= nostr.Now()
+}
+
+func (b Ban) Describe() string {
+	if b.Expires == 0 {
+		return b.Reason
+	}
+
+	return fmt.Sprintf("%s (until %s)", b.Reason, b.Expires.Time().UTC().Format(time.RFC3339))
+}
+
+// A ban duration and purge mode may be given at the start of the reason, for example
+// "24h: spamming", "delete: spamming", or "7d,hide: spamming"
+var banOptionsPattern = regexp.MustCompile(`^\s*([a-z0-9]+(?:\s*,\s*[a-z0-9]+)?)\s*:\s*`)
+
+// ParseBanDuration works like time.ParseDuration, but also accepts days and weeks
+func ParseBanDuration(s string) (time.Duration, error) {
+	if n, ok := strings.CutSuffix(s, "d"); ok {
+		if days, err := strconv.Atoi(n); err == nil {
+			return time.Duration(days) * 24 * time.Hour, nil
+		}
+	}
+
+	if n, ok := strings.CutSuffix(s, "w"); ok {
+		if weeks, err := strconv.Atoi(n); err == nil {
+			return time.Duration(weeks) * 7 * 24 * time.Hour, nil
+		}
+	}
+
+	return time.ParseDuration(s)
+}
+
+// ParseBanReason splits a leading duration and purge mode off of a ban reason, if there are
+// any. The reason is left alone unless every option is valid.
+func ParseBanReason(reason string) (string, time.Duration, string) {
+	match := banOptionsPattern.FindStringSubmatch(reason)
+	if match == nil {
+		return reason, 0, ""
+	}
+
+	duration := time.Duration(0)
+	purge := ""
+
+	for _, option := range strings.Split(match[1], ",") {
+		option = strings.TrimSpace(option)
+
+		if slices.Contains(PURGE_MODES, option) && purge == "" {
+			purge = option
+		} else if d, err := ParseBanDuration(option); err == nil && d > 0 && duration == 0 {
+			duration = d
+		} else {
+			return reason, 0, ""
+		}
+	}
+
+	return reason[len(match[0]):], duration, purge
+}
+
+// parseBan reads a stored ban. Anything that isn't a JSON object is an older entry consisting of
+// just the reason, which may be empty.
+func parseBan(data []byte) Ban {
+	var ban Ban
+	if !bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) || json.Unmarshal(data, &ban) != nil {
+		ban = Ban{Reason: string(data)}
+	}
+
+	return ban
+}
+
+func GetBanRecord(pubkey string) *Ban {
+	// Empty values come back as nil, so check for the key rather than the value
+	if !HasItem("bannedpubkey", pubkey) {
+		return nil
+	}
+
+	ban := parseBan(GetItem("bannedpubkey", pubkey))
+
+	return &ban
+}
+
+// GetBan returns the pubkey's ban, if it has an active one
+func GetBan(pubkey string) *Ban {
+	if ban := GetBanRecord(pubkey); ban != nil && !ban.IsExpired() {
+		return ban
+	}
+
+	return nil
+}
+
+func IsBanned(pubkey string) bool {
+	return pubkey != "" && GetBan(pubkey) != nil
+}
+
+// BanPubKey bans pubkey for duration, or permanently if duration is zero. Purging content is
+// up to the caller, see PurgePubKey.
+func BanPubKey(pubkey string, reason string, duration time.Duration, purge string) Ban {
+	ban := Ban{
+		Reason:    reason,
+		Purge:     purge,
+		CreatedAt: nostr.Now(),
+	}
+
+	if duration > 0 {
+		ban.Expires = nostr.Timestamp(time.Now().Add(duration).Unix())
+	}
+
+	data, err := json.Marshal(ban)
+	if err != nil {
+		log.Println(err)
+	} else {
+		PutItem("bannedpubkey", pubkey, data)
+	}
+
+	return ban
+}
+
+func UnbanPubKey(pubkey string) {
+	DeleteItem("bannedpubkey", pubkey)
+}
+
+func ListBans() map[string]Ban {
+	bans := make(map[string]Ban)
+
+	for pubkey, item := range ListItems("bannedpubkey") {
+		if ban := parseBan([]byte(item)); !ban.IsExpired() {
+			bans[pubkey] = ban
+		}
+	}
+
+	return bans
+}
+
+// PruneExpiredBans removes lapsed bans, and returns the pubkeys which are no longer banned
+func PruneExpiredBans() []string {
+	lifted := make([]string, 0)
+
+	for pubkey, item := range ListItems("bannedpubkey") {
+		if ban := parseBan([]byte(item)); ban.IsExpired() {
+			UnbanPubKey(pubkey)
+			Audit(RELAY_SELF, "unbanpubkey", pubkey, "ban expired")
+			lifted = append(lifted, pubkey)
+		}
+	}
+
+	return lifted
+}
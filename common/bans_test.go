@@ -0,0 +1,97 @@
+package common
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestParseBan(t *testing.T) {
+	cases := map[string]Ban{
+		``:                                 {},
+		`spamming`:                         {Reason: "spamming"},
+		`null`:                             {Reason: "null"},
+		`123`:                              {Reason: "123"},
+		`{"reason":"spam"}`:                {Reason: "spam"},
+		`{"reason":"spam","expires":1000}`: {Reason: "spam", Expires: 1000},
+		`{broken`:                          {Reason: "{broken"},
+	}
+
+	for data, expected := range cases {
+		if actual := parseBan([]byte(data)); actual != expected {
+			t.Errorf("parseBan(%q) = %+v, expected %+v", data, actual, expected)
+		}
+	}
+}
+
+func TestLegacyBanRecords(t *testing.T) {
+	_, empty := testKeypair()
+	_, legacy := testKeypair()
+
+	PutItem("bannedpubkey", empty, []byte{})
+	PutItem("bannedpubkey", legacy, []byte("spamming"))
+
+	defer UnbanPubKey(empty)
+	defer UnbanPubKey(legacy)
+
+	if ban := GetBanRecord(empty); ban == nil || ban.Reason != "" {
+		t.Fatalf("expected a ban without a reason, got %+v", ban)
+	}
+
+	if !IsBanned(empty) || !IsBanned(legacy) {
+		t.Fatalf("expected legacy bans to be active")
+	}
+
+	if ban := GetBan(legacy); ban == nil || ban.Reason != "spamming" || ban.Expires != 0 {
+		t.Fatalf("unexpected legacy ban %+v", ban)
+	}
+
+	bans := ListBans()
+	if _, ok := bans[empty]; !ok {
+		t.Fatalf("expected ListBans to include the ban without a reason")
+	}
+}
+
+func TestParseBanReason(t *testing.T) {
+	cases := []struct {
+		input    string
+		reason   string
+		duration time.Duration
+		purge    string
+	}{
+		{"spamming", "spamming", 0, ""},
+		{"24h: spamming", "spamming", 24 * time.Hour, ""},
+		{"7d: spamming", "spamming", 7 * 24 * time.Hour, ""},
+		{"2w:spamming", "spamming", 14 * 24 * time.Hour, ""},
+		{"delete: spamming", "spamming", 0, PURGE_DELETE},
+		{"7d, hide: spamming", "spamming", 7 * 24 * time.Hour, PURGE_HIDE},
+		{"hide,7d: spamming", "spamming", 7 * 24 * time.Hour, PURGE_HIDE},
+		{"hide,delete: spamming", "hide,delete: spamming", 0, ""},
+		{"note: spamming", "note: spamming", 0, ""},
+		{"0h: spamming", "0h: spamming", 0, ""},
+	}
+
+	for _, c := range cases {
+		reason, duration, purge := ParseBanReason(c.input)
+		if reason != c.reason || duration != c.duration || purge != c.purge {
+			t.Errorf("ParseBanReason(%q) = %q, %s, %q, expected %q, %s, %q", c.input, reason, duration, purge, c.reason, c.duration, c.purge)
+		}
+	}
+}
+
+func TestTemporaryBanExpires(t *testing.T) {
+	_, pubkey := testKeypair()
+
+	ban := BanPubKey(pubkey, "cooling off", time.Hour, PURGE_NONE)
+	defer UnbanPubKey(pubkey)
+
+	if !IsBanned(pubkey) || ban.Expires <= nostr.Now() {
+		t.Fatalf("expected an active temporary ban, got %+v", ban)
+	}
+
+	ban.Expires = nostr.Now() - 1
+	if !ban.IsExpired() {
+		t.Fatalf("expected ban to have expired")
+	}
+}
@@ -1,9 +1,11 @@
 package common
 
 import (
+	"cmp"
 	"fmt"
 	"github.com/dgraph-io/badger/v4"
 	"log"
+	"slices"
 	"strings"
 	"sync"
 )
@@ -93,3 +95,71 @@ func ListItems(tbl string) map[string]string {
 
 	return result
 }
+
+// ScanItems calls fn with each item in tbl in key order, or in reverse key order, until fn
+// returns false, without loading the whole table.
+func ScanItems(tbl string, reverse bool, fn func(key string, value []byte) bool) {
+	GetDatabase().View(func(txn *badger.Txn) error {
+		prefix := []byte(tbl + ":")
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = prefix
+		opts.Reverse = reverse
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		// Reverse iteration starts from the last key at or before the seek key
+		start := prefix
+		if reverse {
+			start = append(slices.Clone(prefix), 0xff)
+		}
+
+		for it.Seek(start); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			key := strings.TrimPrefix(string(item.Key()), string(prefix))
+			val, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			if !fn(key, val) {
+				break
+			}
+		}
+		return nil
+	})
+}
+
+// ListKeysByAge returns the keys in tbl, least recently written first, going by the version
+// badger records with each write.
+func ListKeysByAge(tbl string) []string {
+	type versioned struct {
+		key     string
+		version uint64
+	}
+
+	items := make([]versioned, 0)
+
+	GetDatabase().View(func(txn *badger.Txn) error {
+		prefix := tbl + ":"
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Seek([]byte(prefix)); it.ValidForPrefix([]byte(prefix)); it.Next() {
+			item := it.Item()
+			key := strings.TrimPrefix(string(item.Key()), prefix)
+			items = append(items, versioned{key, item.Version()})
+		}
+		return nil
+	})
+
+	slices.SortStableFunc(items, func(a, b versioned) int {
+		return cmp.Compare(a.version, b.version)
+	})
+
+	keys := make([]string, 0, len(items))
+	for _, item := range items {
+		keys = append(keys, item.key)
+	}
+
+	return keys
+}
@@ -3,10 +3,13 @@ package common
 import (
 	"fmt"
 	_ "github.com/joho/godotenv/autoload"
-	"github.com/nbd-wtf/go-nostr"
 	"log"
+	"net"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 )
 
 var PORT string
@@ -16,16 +19,54 @@ var RELAY_NAME string
 var RELAY_ICON string
 var RELAY_ADMINS []string
 var RELAY_SECRET string
+var RELAY_NCRYPTSEC string
+var RELAY_PASSPHRASE_FILE string
+var RELAY_BUNKER string
 var RELAY_SELF string
 var RELAY_DESCRIPTION string
 var RELAY_CLAIMS []string
+var RELAY_CLAIM_TIERS map[string]string
+var RELAY_TIERS map[string][]string
+var RELAY_INVITE_TIER string
+var RELAY_CLAIM_TTL time.Duration
+var RELAY_ENABLE_APPLICATIONS bool
+var RELAY_APPLICATION_TIER string
+var RELAY_PAYMENT_PROVIDER string
+var RELAY_PAYMENT_TIER string
+var RELAY_ENABLE_MOCK_PAYMENTS bool
+var RELAY_MEMBERSHIP_FEE int
+var RELAY_MEMBERSHIP_FEE_UNIT string
+var RELAY_MEMBERSHIP_PERIOD time.Duration
+var RELAY_INVOICE_TTL time.Duration
+var RELAY_INVOICE_RATE_LIMIT int
 var RELAY_AUTH_BACKEND string
+var RELAY_AUTH_BACKEND_VERSION string
+var RELAY_AUTH_BACKEND_TIMEOUT time.Duration
+var RELAY_AUTH_BACKEND_ALLOW_TTL time.Duration
+var RELAY_AUTH_BACKEND_DENY_TTL time.Duration
+var RELAY_AUTH_BACKEND_CACHE_SIZE int
+var RELAY_AUTH_BACKEND_MAX_FAILURES int
+var RELAY_AUTH_BACKEND_COOLDOWN time.Duration
 var RELAY_WHITELIST []string
+var RELAY_WHITELIST_SETS []string
+var RELAY_WHITELIST_CONTACTS bool
+var RELAY_WOT_DEPTH int
+var RELAY_WOT_MIN_FOLLOWERS int
+var RELAY_NIP05_DOMAINS []string
+var RELAY_NIP05_TTL time.Duration
+var RELAY_READ_POLICY []string
+var RELAY_WRITE_POLICY []string
 var RELAY_RESTRICT_USER bool
 var RELAY_RESTRICT_AUTHOR bool
 var RELAY_STRIP_SIGNATURES bool
 var RELAY_GENERATE_CLAIMS bool
 var RELAY_CONSUME_CLAIMS bool
+var RELAY_REVOKE_INVITEES string
+var RELAY_PURGE_ON_BAN string
+var RELAY_TRUSTED_PROXIES []*net.IPNet
+var RELAY_MAX_CONNECTIONS_PER_IP int
+var RELAY_LABEL_NAMESPACE string
+var RELAY_INVITE_QUOTA int
 var RELAY_ENABLE_BLOSSOM bool
 var RELAY_ENABLE_GROUPS bool
 var GROUP_AUTO_JOIN bool
@@ -57,21 +98,171 @@ func SetupEnvironment() {
 	RELAY_NAME = getEnv("RELAY_NAME", "Frith")
 	RELAY_ICON = getEnv("RELAY_ICON", "https://hbr.coracle.social/fd73de98153b615f516d316d663b413205fd2e6e53d2c6064030ab57a7685bbd.jpg")
 	RELAY_ADMINS = Split(getEnv("RELAY_ADMINS", ""), ",")
-	RELAY_SECRET = getEnv("RELAY_SECRET", nostr.GeneratePrivateKey())
-	RELAY_SELF, _ = nostr.GetPublicKey(RELAY_SECRET)
+	RELAY_SECRET = getEnv("RELAY_SECRET", "")
+	RELAY_NCRYPTSEC = getEnv("RELAY_NCRYPTSEC", "")
+	RELAY_PASSPHRASE_FILE = getEnv("RELAY_PASSPHRASE_FILE", "")
+	RELAY_BUNKER = getEnv("RELAY_BUNKER", "")
+	RELAY_SELF = SetupRelaySigner()
 	RELAY_DESCRIPTION = getEnv("RELAY_DESCRIPTION", "A nostr relay for hosting groups.")
-	RELAY_CLAIMS = Split(getEnv("RELAY_CLAIMS", ""), ",")
+	RELAY_CLAIMS, RELAY_CLAIM_TIERS = parseClaims(getEnv("RELAY_CLAIMS", ""))
+	RELAY_TIERS = parseTiers(getEnv("RELAY_TIERS", ""))
+	RELAY_INVITE_TIER = getEnv("RELAY_INVITE_TIER", "")
+	RELAY_CLAIM_TTL = parseDuration(getEnv("RELAY_CLAIM_TTL", "0"), 0)
+	RELAY_ENABLE_APPLICATIONS = getEnv("RELAY_ENABLE_APPLICATIONS", "false") == "true"
+	RELAY_APPLICATION_TIER = getEnv("RELAY_APPLICATION_TIER", "")
+	RELAY_PAYMENT_PROVIDER = getEnv("RELAY_PAYMENT_PROVIDER", "")
+	RELAY_PAYMENT_TIER = getEnv("RELAY_PAYMENT_TIER", "")
+	RELAY_ENABLE_MOCK_PAYMENTS = getEnv("RELAY_ENABLE_MOCK_PAYMENTS", "false") == "true"
+	RELAY_MEMBERSHIP_FEE = parseInt(getEnv("RELAY_MEMBERSHIP_FEE", "0"), 0)
+	RELAY_MEMBERSHIP_FEE_UNIT = getEnv("RELAY_MEMBERSHIP_FEE_UNIT", "sats")
+	RELAY_MEMBERSHIP_PERIOD = parseDuration(getEnv("RELAY_MEMBERSHIP_PERIOD", "720h"), 720*time.Hour)
+	RELAY_INVOICE_TTL = parseDuration(getEnv("RELAY_INVOICE_TTL", "24h"), 24*time.Hour)
+	RELAY_INVOICE_RATE_LIMIT = parseInt(getEnv("RELAY_INVOICE_RATE_LIMIT", "10"), 10)
 	RELAY_AUTH_BACKEND = getEnv("RELAY_AUTH_BACKEND", "")
+	RELAY_AUTH_BACKEND_VERSION = getEnv("RELAY_AUTH_BACKEND_VERSION", "1")
+	RELAY_AUTH_BACKEND_TIMEOUT = parseDuration(getEnv("RELAY_AUTH_BACKEND_TIMEOUT", "5s"), 5*time.Second)
+	RELAY_AUTH_BACKEND_ALLOW_TTL = parseDuration(getEnv("RELAY_AUTH_BACKEND_ALLOW_TTL", "1m"), time.Minute)
+	RELAY_AUTH_BACKEND_DENY_TTL = parseDuration(getEnv("RELAY_AUTH_BACKEND_DENY_TTL", "1m"), time.Minute)
+	RELAY_AUTH_BACKEND_CACHE_SIZE = parseInt(getEnv("RELAY_AUTH_BACKEND_CACHE_SIZE", "10000"), 10000)
+	RELAY_AUTH_BACKEND_MAX_FAILURES = parseInt(getEnv("RELAY_AUTH_BACKEND_MAX_FAILURES", "5"), 5)
+	RELAY_AUTH_BACKEND_COOLDOWN = parseDuration(getEnv("RELAY_AUTH_BACKEND_COOLDOWN", "30s"), 30*time.Second)
 	RELAY_WHITELIST = Split(getEnv("RELAY_WHITELIST", ""), ",")
+	RELAY_WHITELIST_SETS = Split(getEnv("RELAY_WHITELIST_SETS", ""), ",")
+	RELAY_WHITELIST_CONTACTS = getEnv("RELAY_WHITELIST_CONTACTS", "false") == "true"
+	RELAY_WOT_DEPTH = parseInt(getEnv("RELAY_WOT_DEPTH", "0"), 0)
+	RELAY_WOT_MIN_FOLLOWERS = parseInt(getEnv("RELAY_WOT_MIN_FOLLOWERS", "1"), 1)
+	RELAY_NIP05_DOMAINS = Split(strings.ToLower(getEnv("RELAY_NIP05_DOMAINS", "")), ",")
+	RELAY_NIP05_TTL = parseDuration(getEnv("RELAY_NIP05_TTL", "24h"), 24*time.Hour)
+	RELAY_READ_POLICY = parsePolicy(getEnv("RELAY_READ_POLICY", "admins,whitelist,claims,backend"))
+	RELAY_WRITE_POLICY = parsePolicy(getEnv("RELAY_WRITE_POLICY", "admins,whitelist,claims,backend"))
 	RELAY_RESTRICT_USER = getEnv("RELAY_RESTRICT_USER", "true") == "true"
 	RELAY_RESTRICT_AUTHOR = getEnv("RELAY_RESTRICT_AUTHOR", "false") == "true"
 	RELAY_STRIP_SIGNATURES = getEnv("RELAY_STRIP_SIGNATURES", "false") == "true"
 	RELAY_GENERATE_CLAIMS = getEnv("RELAY_GENERATE_CLAIMS", "false") == "true"
 	RELAY_CONSUME_CLAIMS = getEnv("RELAY_CONSUME_CLAIMS", "false") == "true"
+	RELAY_REVOKE_INVITEES = getEnv("RELAY_REVOKE_INVITEES", "none")
+	RELAY_PURGE_ON_BAN = getEnv("RELAY_PURGE_ON_BAN", "none")
+	RELAY_TRUSTED_PROXIES = parseIPRanges(getEnv("RELAY_TRUSTED_PROXIES", ""))
+	RELAY_MAX_CONNECTIONS_PER_IP = parseInt(getEnv("RELAY_MAX_CONNECTIONS_PER_IP", "0"), 0)
+	RELAY_LABEL_NAMESPACE = getEnv("RELAY_LABEL_NAMESPACE", "moderation")
+	RELAY_INVITE_QUOTA = parseInt(getEnv("RELAY_INVITE_QUOTA", "1"), 1)
 	RELAY_ENABLE_BLOSSOM = getEnv("RELAY_ENABLE_BLOSSOM", "false") == "true"
 	RELAY_ENABLE_GROUPS = getEnv("RELAY_ENABLE_GROUPS", "false") == "true"
 	GROUP_AUTO_JOIN = getEnv("GROUP_AUTO_JOIN", "false") == "true"
 	GROUP_AUTO_LEAVE = getEnv("GROUP_AUTO_LEAVE", "true") == "true"
+
+	validateTiers()
+
+	// Each entry is evicted as soon as it's added to an empty cache, which would quietly disable
+	// caching along with serving stale entries while the backend is down
+	if RELAY_AUTH_BACKEND_CACHE_SIZE < 1 {
+		log.Fatalf("RELAY_AUTH_BACKEND_CACHE_SIZE must be at least 1, got %d", RELAY_AUTH_BACKEND_CACHE_SIZE)
+	}
+}
+
+// validateTiers makes sure every tier that can be granted is defined, since an unknown tier
+// would silently grant nothing.
+func validateTiers() {
+	referenced := map[string]string{
+		"RELAY_INVITE_TIER":      RELAY_INVITE_TIER,
+		"RELAY_APPLICATION_TIER": RELAY_APPLICATION_TIER,
+		"RELAY_PAYMENT_TIER":     RELAY_PAYMENT_TIER,
+	}
+
+	for claim, tier := range RELAY_CLAIM_TIERS {
+		referenced["RELAY_CLAIMS "+claim] = tier
+	}
+
+	for source, tier := range referenced {
+		if _, ok := RELAY_TIERS[tier]; tier != "" && !ok {
+			log.Fatalf("Unknown tier %s in %s, expected one of %v", tier, source, Keys(RELAY_TIERS))
+		}
+	}
+}
+
+// parseClaims splits a list like "abc,def:lurker" into claims and the tiers they grant.
+func parseClaims(s string) ([]string, map[string]string) {
+	claims := make([]string, 0)
+	tiers := make(map[string]string)
+
+	for _, item := range Split(s, ",") {
+		claim, tier, _ := strings.Cut(item, ":")
+		claims = append(claims, claim)
+
+		if tier != "" {
+			tiers[claim] = tier
+		}
+	}
+
+	return claims, tiers
+}
+
+// parseTiers parses a list like "lurker:read;member:read,write" into tiers and their capabilities.
+func parseTiers(s string) map[string][]string {
+	tiers := make(map[string][]string)
+
+	for _, item := range Split(s, ";") {
+		name, capabilities, _ := strings.Cut(item, ":")
+		tiers[name] = Split(capabilities, ",")
+
+		for _, capability := range tiers[name] {
+			if !slices.Contains(CAPABILITIES, capability) {
+				log.Printf("Unknown capability %s in tier %s", capability, name)
+			}
+		}
+	}
+
+	return tiers
+}
+
+// parsePolicy parses a comma-separated chain of access sources like "admins,claims".
+func parsePolicy(s string) []string {
+	sources := Split(s, ",")
+
+	for _, source := range sources {
+		if !slices.Contains(POLICY_SOURCES, source) {
+			log.Printf("Unknown access policy source %s", source)
+		}
+	}
+
+	return sources
+}
+
+// parseIPRanges parses a comma-separated list of IP addresses and CIDR ranges.
+func parseIPRanges(s string) []*net.IPNet {
+	ranges := make([]*net.IPNet, 0)
+
+	for _, item := range Split(s, ",") {
+		ipnet, err := ParseIPRange(item)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		ranges = append(ranges, ipnet)
+	}
+
+	return ranges
+}
+
+func parseInt(s string, fallback int) int {
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		log.Printf("Invalid number %s, using %d instead", s, fallback)
+		return fallback
+	}
+
+	return n
+}
+
+func parseDuration(s string, fallback time.Duration) time.Duration {
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		log.Printf("Invalid duration %s, using %s instead", s, fallback)
+		return fallback
+	}
+
+	return d
 }
 
 func GetDataDir(dir string) string {
@@ -0,0 +1,49 @@
+package common
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParsePolicy(t *testing.T) {
+	cases := map[string][]string{
+		"":                         {},
+		"admins":                   {POLICY_ADMINS},
+		"admins,whitelist,claims":  {POLICY_ADMINS, POLICY_WHITELIST, POLICY_CLAIMS},
+		"authenticated,wot,nip05":  {POLICY_AUTHENTICATED, POLICY_WOT, POLICY_NIP05},
+		"backend,admins":           {POLICY_BACKEND, POLICY_ADMINS},
+		"admins,unknown,whitelist": {POLICY_ADMINS, "unknown", POLICY_WHITELIST},
+	}
+
+	for s, expected := range cases {
+		if actual := parsePolicy(s); !slices.Equal(actual, expected) {
+			t.Errorf("parsePolicy(%q) = %v, expected %v", s, actual, expected)
+		}
+	}
+}
+
+func TestParseClaimsAndTiers(t *testing.T) {
+	claims, claimTiers := parseClaims("abc,def:lurker,ghi:member")
+
+	if !slices.Equal(claims, []string{"abc", "def", "ghi"}) {
+		t.Errorf("expected every claim without its tier, got %v", claims)
+	}
+
+	if len(claimTiers) != 2 || claimTiers["def"] != "lurker" || claimTiers["ghi"] != "member" {
+		t.Errorf("expected tiers for claims that name one, got %v", claimTiers)
+	}
+
+	tiers := parseTiers("lurker:read;member:read,write,invite;empty:")
+
+	cases := map[string][]string{
+		"lurker": {CAP_READ},
+		"member": {CAP_READ, CAP_WRITE, CAP_INVITE},
+		"empty":  {},
+	}
+
+	for tier, expected := range cases {
+		if actual, ok := tiers[tier]; !ok || !slices.Equal(actual, expected) {
+			t.Errorf("expected tier %s to have %v, got %v", tier, expected, actual)
+		}
+	}
+}
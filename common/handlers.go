@@ -7,6 +7,7 @@ import (
 
 	"github.com/fiatjaf/khatru"
 	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip29"
 )
 
 // RejectFilter
@@ -19,8 +20,12 @@ func RejectFilter(ctx context.Context, filter nostr.Filter) (reject bool, msg st
 			return true, "auth-required: authentication is required for access"
 		}
 
-		if !HasAccess(pubkey) {
-			return true, "restricted: you are not a member of this relay"
+		if granted, reason := CheckAccess(AccessRequest{PubKey: pubkey, Action: CAP_READ}); !granted {
+			if reason == "" {
+				reason = "you are not a member of this relay"
+			}
+
+			return true, "restricted: " + reason
 		}
 	}
 
@@ -62,16 +67,39 @@ func QueryEvents(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, e
 			}
 		}
 
+		if slices.Contains(filter.Kinds, nostr.KindLabel) {
+			for _, event := range GenerateLabelEvents(ctx, filter) {
+				ch <- stripSignature(event)
+			}
+		}
+
 		upstream, err := GetBackend().QueryEvents(ctx, filter)
 
 		if err != nil {
 			log.Println(err)
 		}
 
+		cache := newQueryCache(ctx, pubkey)
+
 		for event := range upstream {
-			g := GetGroupFromEvent(event)
+			// Content from banned pubkeys may be hidden for as long as the ban lasts
+			if cache.isHidden(event.PubKey) && !slices.Contains(RELAY_ADMINS, pubkey) {
+				continue
+			}
+
+			if !CanSeeEvent(pubkey, event) {
+				continue
+			}
+
+			h := GetGroupIDFromEvent(event)
+			g := cache.getGroup(h)
 
-			if g == nil || !g.Private || IsGroupMember(ctx, g.Address.ID, pubkey) {
+			// Groups may hide events carrying certain labels
+			if g != nil && !slices.Contains(RELAY_ADMINS, pubkey) && cache.getBlockedLabel(h, event) != "" {
+				continue
+			}
+
+			if g == nil || !g.Private || cache.isMember(h) {
 				ch <- stripSignature(event)
 			}
 		}
@@ -80,6 +108,95 @@ func QueryEvents(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, e
 	return ch, nil
 }
 
+// queryCache remembers lookups made while filtering the results of a single query, since
+// results tend to share authors and groups
+type queryCache struct {
+	ctx          context.Context
+	pubkey       string
+	hidden       map[string]bool
+	groups       map[string]*nip29.Group
+	members      map[string]bool
+	rules        map[string][]string
+	authorLabels map[string][]string
+}
+
+func newQueryCache(ctx context.Context, pubkey string) *queryCache {
+	return &queryCache{
+		ctx:          ctx,
+		pubkey:       pubkey,
+		hidden:       make(map[string]bool),
+		groups:       make(map[string]*nip29.Group),
+		members:      make(map[string]bool),
+		rules:        make(map[string][]string),
+		authorLabels: make(map[string][]string),
+	}
+}
+
+func (c *queryCache) isHidden(author string) bool {
+	hidden, ok := c.hidden[author]
+	if !ok {
+		hidden = IsHidden(author)
+		c.hidden[author] = hidden
+	}
+
+	return hidden
+}
+
+func (c *queryCache) getGroup(h string) *nip29.Group {
+	if h == "" {
+		return nil
+	}
+
+	g, ok := c.groups[h]
+	if !ok {
+		g = GetGroup(h)
+		c.groups[h] = g
+	}
+
+	return g
+}
+
+func (c *queryCache) isMember(h string) bool {
+	member, ok := c.members[h]
+	if !ok {
+		member = IsGroupMember(c.ctx, h, c.pubkey)
+		c.members[h] = member
+	}
+
+	return member
+}
+
+func (c *queryCache) getBlockedLabel(h string, event *nostr.Event) string {
+	rules, ok := c.rules[h]
+	if !ok {
+		rules = GetGroupLabelRules(h)
+		c.rules[h] = rules
+	}
+
+	if len(rules) == 0 {
+		return ""
+	}
+
+	authorLabels, ok := c.authorLabels[event.PubKey]
+	if !ok {
+		if labels := GetLabels(event.PubKey); labels != nil {
+			authorLabels = labels.Labels
+		}
+
+		c.authorLabels[event.PubKey] = authorLabels
+	}
+
+	if label := findBlockedLabel(rules, authorLabels); label != "" {
+		return label
+	}
+
+	if labels := GetLabels(event.ID); labels != nil {
+		return findBlockedLabel(rules, labels.Labels)
+	}
+
+	return ""
+}
+
 // RejectEvent
 
 func RejectEvent(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
@@ -89,19 +206,52 @@ func RejectEvent(ctx context.Context, event *nostr.Event) (reject bool, msg stri
 	if pubkey != "" && event.Kind == AUTH_JOIN {
 		tag := event.Tags.GetFirst([]string{"claim"})
 
+		// Banned and revoked pubkeys can't use up anyone's invite, or join the invite tree
+		if tag != nil && IsBanned(pubkey) {
+			return true, "restricted: you have been banned from this relay"
+		}
+
+		if tag != nil && IsRevoked(pubkey) {
+			return true, "restricted: your access has been revoked"
+		}
+
 		if tag != nil {
 			claim := tag.Value()
 
-			if IsValidClaim(claim) || HasAccess(ConsumeInvite(claim)) {
+			if IsValidClaim(claim) {
 				AddUserClaim(pubkey, claim)
+				AuditWithDetails(pubkey, "join", pubkey, "", map[string]any{"claim": claim})
+			} else if inviter := ConsumeInvite(claim); HasCapability(inviter, CAP_INVITE) {
+				AddUserClaim(pubkey, claim)
+				AddInvitee(inviter, pubkey)
+				AuditWithDetails(pubkey, "join", pubkey, "", map[string]any{"claim": claim, "inviter": inviter})
 			}
 
-			if RELAY_RESTRICT_USER && !HasAccess(pubkey) {
-				return true, "restricted: failed to validate invite code"
-			}
+			UpdateMembership(pubkey)
+		}
+
+		// Without a valid claim, the join request may be reviewed by an admin instead
+		if RELAY_ENABLE_APPLICATIONS && !HasAccess(pubkey) {
+			return true, SubmitApplication(pubkey, event.Content)
+		}
+
+		if tag != nil && RELAY_RESTRICT_USER && !HasAccess(pubkey) {
+			return true, "restricted: failed to validate invite code"
 		}
 	}
 
+	// Process relay-level leave requests, which are accepted even though access is revoked
+	if pubkey != "" && event.Kind == AUTH_LEAVE {
+		if pubkey != event.PubKey {
+			return true, "restricted: you cannot publish events on behalf of others"
+		}
+
+		RemoveAccess(pubkey)
+		Audit(pubkey, "leave", pubkey, "")
+
+		return false, ""
+	}
+
 	recipientAuthKinds := []int{
 		nostr.KindZap,
 		1059,
@@ -121,16 +271,31 @@ func RejectEvent(ctx context.Context, event *nostr.Event) (reject bool, msg stri
 		return true, "restricted: you cannot publish events on behalf of others"
 	}
 
-	// Check both restrict settings since they're the same here
-	if (RELAY_RESTRICT_USER || RELAY_RESTRICT_AUTHOR) && !HasAccess(pubkey) {
-		return true, "restricted: you are not a member of this relay"
+	h := GetGroupIDFromEvent(event)
+	g := GetGroup(h)
+
+	// Check both restrict settings since they're the same here. Join requests only need to
+	// have been granted some access, since the claim may not include write access.
+	if RELAY_RESTRICT_USER || RELAY_RESTRICT_AUTHOR {
+		req := AccessRequest{PubKey: pubkey, Action: CAP_WRITE, Kind: &event.Kind, Group: h}
+		fallback := "you are not allowed to publish to this relay"
+
+		if event.Kind == AUTH_JOIN {
+			req.Action = ACTION_JOIN
+			fallback = "you are not a member of this relay"
+		}
+
+		if granted, reason := CheckAccess(req); !granted {
+			if reason == "" {
+				reason = fallback
+			}
+
+			return true, "restricted: " + reason
+		}
 	}
 
 	// Group-level access
 
-	h := GetGroupIDFromEvent(event)
-	g := GetGroup(h)
-
 	groupMetaKinds := []int{
 		nostr.KindSimpleGroupMetadata,
 		nostr.KindSimpleGroupAdmins,
@@ -154,6 +319,16 @@ func RejectEvent(ctx context.Context, event *nostr.Event) (reject bool, msg stri
 
 	groupKinds := slices.Concat(groupAdminKinds, groupRequestKinds)
 
+	membershipKinds := []int{
+		KindMembershipList,
+		KindAddMember,
+		KindRemoveMember,
+	}
+
+	if slices.Contains(membershipKinds, event.Kind) {
+		return true, "invalid: relay membership cannot be set directly"
+	}
+
 	if slices.Contains(groupMetaKinds, event.Kind) {
 		return true, "invalid: group metadata cannot be set directly"
 	}
@@ -163,8 +338,13 @@ func RejectEvent(ctx context.Context, event *nostr.Event) (reject bool, msg stri
 			return true, "invalid: group events not accepted on this relay"
 		}
 
-		if !slices.Contains(RELAY_ADMINS, pubkey) {
-			return true, "restricted: only relay admins can manage groups"
+		canCreate := false
+		if event.Kind == nostr.KindSimpleGroupCreateGroup {
+			canCreate, _ = CheckAccess(AccessRequest{PubKey: pubkey, Action: CAP_GROUPS, Kind: &event.Kind, Group: h})
+		}
+
+		if !canCreate && !IsGroupAdmin(h, pubkey) {
+			return true, "restricted: only group admins can manage this group"
 		}
 	}
 
@@ -212,6 +392,10 @@ func RejectEvent(ctx context.Context, event *nostr.Event) (reject bool, msg stri
 		if !slices.Contains(groupRequestKinds, event.Kind) && g.Closed && !IsGroupMember(ctx, h, pubkey) {
 			return true, "restricted: you are not a member of this group"
 		}
+
+		if label := GetBlockedGroupLabel(h, event); label != "" {
+			return true, "blocked: content labelled " + label + " is not allowed in this group"
+		}
 	}
 
 	return false, ""
@@ -226,13 +410,21 @@ func SaveEvent(ctx context.Context, event *nostr.Event) error {
 // OnEventSaved
 
 func OnEventSaved(ctx context.Context, event *nostr.Event) {
+	FlagShadowedEvent(event)
+
 	if event.Kind == nostr.KindSimpleGroupJoinRequest && GROUP_AUTO_JOIN {
 		putUserEvent := MakePutUserEvent(event)
 
+		// Shadow-banned pubkeys are let in without anyone else finding out
+		if IsShadowBanned(event.PubKey) {
+			FlagShadowedEventFor(putUserEvent, event.PubKey)
+		}
+
 		if err := GetBackend().SaveEvent(ctx, putUserEvent); err != nil {
 			log.Println(err)
 		} else {
 			GetRelay().BroadcastEvent(putUserEvent)
+			AuditGroupModeration(putUserEvent)
 		}
 	}
 
@@ -243,9 +435,16 @@ func OnEventSaved(ctx context.Context, event *nostr.Event) {
 			log.Println(err)
 		} else {
 			GetRelay().BroadcastEvent(removeUserEvent)
+			AuditGroupModeration(removeUserEvent)
 		}
 	}
 
+	AuditGroupModeration(event)
+
+	if event.Kind == nostr.KindReporting {
+		IndexReport(ctx, event)
+	}
+
 	if event.Kind == nostr.KindSimpleGroupCreateGroup {
 		HandleCreateGroup(event)
 	}
@@ -257,10 +456,51 @@ func OnEventSaved(ctx context.Context, event *nostr.Event) {
 	if event.Kind == nostr.KindSimpleGroupDeleteGroup {
 		HandleDeleteGroup(event)
 	}
+
+	if IsWhitelistEvent(event) {
+		RefreshListWhitelist()
+		SyncMembership()
+	}
+
+	if event.Kind == nostr.KindFollowList {
+		HandleContactList(event)
+	}
+
+	if event.Kind == nostr.KindProfileMetadata {
+		HandleProfile(event)
+	}
+}
+
+// OnEphemeralEvent
+
+func OnEphemeralEvent(ctx context.Context, event *nostr.Event) {
+	// Members may rotate their invite code by publishing an invite event of their own. Invite
+	// events are ephemeral, so this is never stored.
+	if event.Kind == AUTH_INVITE && RELAY_GENERATE_CLAIMS && HasCapability(event.PubKey, CAP_INVITE) {
+		RotateInvite(event.PubKey)
+	}
+}
+
+// PreventBroadcast
+
+func PreventBroadcast(ws *khatru.WebSocket, event *nostr.Event) bool {
+	// Only the relay issues invite codes, so don't pass on anyone else's invite events
+	return event.Kind == AUTH_INVITE && event.PubKey != RELAY_SELF
 }
 
 // DeleteEvent
 
 func DeleteEvent(ctx context.Context, event *nostr.Event) error {
-	return GetBackend().DeleteEvent(ctx, event)
+	if err := GetBackend().DeleteEvent(ctx, event); err != nil {
+		return err
+	}
+
+	UnflagShadowedEvent(event)
+
+	if IsWhitelistEvent(event) {
+		RefreshListWhitelist()
+		SyncMembership()
+	}
+
+	return nil
 }
@@ -0,0 +1,119 @@
+package common
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// connectAs opens a websocket connection to the relay, authenticated as secret
+func connectAs(t *testing.T, secret string) *nostr.Relay {
+	ctx := context.Background()
+
+	server := httptest.NewServer(GetRelay())
+	t.Cleanup(server.Close)
+
+	conn, err := nostr.RelayConnect(ctx, "ws"+strings.TrimPrefix(server.URL, "http"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { conn.Close() })
+
+	// Wait for the challenge before responding to it
+	for range 100 {
+		if err := conn.Auth(ctx, func(event *nostr.Event) error { return event.Sign(secret) }); err == nil {
+			return conn
+		}
+	}
+
+	t.Fatal("failed to authenticate")
+
+	return nil
+}
+
+func publish(t *testing.T, conn *nostr.Relay, secret string, event nostr.Event) error {
+	event.CreatedAt = nostr.Now()
+	event.Sign(secret)
+
+	return conn.Publish(context.Background(), event)
+}
+
+func TestOnlyGroupTiersCanCreateGroups(t *testing.T) {
+	defer func(enabled bool) { RELAY_ENABLE_GROUPS = enabled }(RELAY_ENABLE_GROUPS)
+	RELAY_ENABLE_GROUPS = true
+
+	defer func(claims []string) { RELAY_CLAIMS = claims }(RELAY_CLAIMS)
+	defer func(tiers map[string]string) { RELAY_CLAIM_TIERS = tiers }(RELAY_CLAIM_TIERS)
+	defer func(tiers map[string][]string) { RELAY_TIERS = tiers }(RELAY_TIERS)
+
+	RELAY_CLAIMS = []string{"member", "organizer"}
+	RELAY_CLAIM_TIERS = map[string]string{"organizer": "organizer"}
+	RELAY_TIERS = map[string][]string{"organizer": {CAP_READ, CAP_WRITE, CAP_GROUPS}}
+
+	memberSecret, member := testKeypair()
+	organizerSecret, organizer := testKeypair()
+
+	AddUserClaim(member, "member")
+	AddUserClaim(organizer, "organizer")
+
+	createGroup := nostr.Event{Kind: nostr.KindSimpleGroupCreateGroup, Tags: nostr.Tags{{"h", RandomString(8)}}}
+
+	err := publish(t, connectAs(t, memberSecret), memberSecret, createGroup)
+	if err == nil || !strings.Contains(err.Error(), "only group admins") {
+		t.Fatalf("expected a plain member to be refused creating a group, got %v", err)
+	}
+
+	if err := publish(t, connectAs(t, organizerSecret), organizerSecret, createGroup); err != nil {
+		t.Fatalf("expected a tier with groups to be able to create a group, got %v", err)
+	}
+
+	if HasCapability(member, CAP_GROUPS) {
+		t.Fatalf("expected claims without a tier not to grant groups")
+	}
+
+	defer func(whitelist []string) { RELAY_WHITELIST = whitelist }(RELAY_WHITELIST)
+	RELAY_WHITELIST = []string{member}
+
+	if !HasCapability(member, CAP_WRITE) || HasCapability(member, CAP_GROUPS) {
+		t.Fatalf("expected the whitelist to grant everything except groups")
+	}
+
+	if !HasCapability(testAdmin, CAP_GROUPS) {
+		t.Fatalf("expected admins to be able to create groups")
+	}
+}
+
+func TestBannedPubKeysCannotUseInvites(t *testing.T) {
+	defer func(consume bool) { RELAY_CONSUME_CLAIMS = consume }(RELAY_CONSUME_CLAIMS)
+	RELAY_CONSUME_CLAIMS = true
+
+	bannedSecret, banned := testKeypair()
+	revokedSecret, revoked := testKeypair()
+
+	BanPubKey(banned, "spam", 0, PURGE_NONE)
+	defer UnbanPubKey(banned)
+
+	RevokeAccess(revoked, "spam", REVOKE_INVITEES_NONE)
+	defer ReinstateAccess(revoked)
+
+	for secret, pubkey := range map[string]string{bannedSecret: banned, revokedSecret: revoked} {
+		claim := GenerateInvite(testAdmin)
+		join := nostr.Event{Kind: AUTH_JOIN, Tags: nostr.Tags{{"claim", claim}}}
+
+		if err := publish(t, connectAs(t, secret), secret, join); err == nil {
+			t.Fatalf("expected the join request to be refused")
+		}
+
+		if !HasItem("invite", claim) {
+			t.Fatalf("expected the invite not to be used up")
+		}
+
+		if GetInviter(pubkey) != "" || len(GetUserClaims(pubkey)) > 0 {
+			t.Fatalf("expected the join request to have no effect")
+		}
+	}
+}
@@ -0,0 +1,274 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+)
+
+// Connection-level blocking by IP address or range, along with per-IP connection caps.
+// Blocked ranges are stored in CIDR notation, with single addresses stored as /32 or /128.
+
+// A connection's slot is reserved when it's accepted, and released when it disconnects. If the
+// connection never gets as far as connecting, the reservation lapses after ipReservationTTL.
+
+const ipReservationTTL = 30 * time.Second
+
+var (
+	ip_connections     = make(map[string]int)
+	ip_reservations    = make(map[*http.Request]string)
+	ip_connectionsLock sync.Mutex
+)
+
+// Parsed blocked ranges, loaded from the database on first use and whenever they change
+var (
+	blocked_ranges     []*net.IPNet
+	blocked_rangesLock sync.RWMutex
+)
+
+// ParseIPRange accepts either a single IP address or a CIDR range
+func ParseIPRange(s string) (*net.IPNet, error) {
+	s = strings.TrimSpace(s)
+
+	if _, ipnet, err := net.ParseCIDR(s); err == nil {
+		return ipnet, nil
+	}
+
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP address or range: %s", s)
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	for _, ipnet := range RELAY_TRUSTED_PROXIES {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// getRemoteIP returns the address of whoever is directly connected, which may be a proxy
+func getRemoteIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	return net.ParseIP(host)
+}
+
+// GetClientIP returns the address a request came from. X-Forwarded-For is only believed when
+// the request came through one of RELAY_TRUSTED_PROXIES, in which case the client is the last
+// address in the chain that isn't a trusted proxy itself.
+func GetClientIP(r *http.Request) net.IP {
+	ip := getRemoteIP(r)
+	if ip == nil || !isTrustedProxy(ip) {
+		return ip
+	}
+
+	hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+
+		ip = hop
+
+		if !isTrustedProxy(hop) {
+			break
+		}
+	}
+
+	return ip
+}
+
+func BlockIP(ipnet *net.IPNet, reason string) {
+	PutItem("blockedip", ipnet.String(), []byte(reason))
+	loadBlockedRanges()
+}
+
+func UnblockIP(ipnet *net.IPNet) {
+	DeleteItem("blockedip", ipnet.String())
+	loadBlockedRanges()
+}
+
+func loadBlockedRanges() []*net.IPNet {
+	ranges := make([]*net.IPNet, 0)
+
+	for cidr := range ListBlockedIPs() {
+		if _, ipnet, err := net.ParseCIDR(cidr); err == nil {
+			ranges = append(ranges, ipnet)
+		}
+	}
+
+	blocked_rangesLock.Lock()
+	blocked_ranges = ranges
+	blocked_rangesLock.Unlock()
+
+	return ranges
+}
+
+func getBlockedRanges() []*net.IPNet {
+	blocked_rangesLock.RLock()
+	ranges := blocked_ranges
+	blocked_rangesLock.RUnlock()
+
+	if ranges == nil {
+		ranges = loadBlockedRanges()
+	}
+
+	return ranges
+}
+
+func ListBlockedIPs() map[string]string {
+	return ListItems("blockedip")
+}
+
+func IsBlockedIP(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+
+	for _, ipnet := range getBlockedRanges() {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func RejectConnection(r *http.Request) bool {
+	ip := GetClientIP(r)
+
+	if IsBlockedIP(ip) {
+		return true
+	}
+
+	if RELAY_MAX_CONNECTIONS_PER_IP > 0 && ip != nil {
+		ip_connectionsLock.Lock()
+		defer ip_connectionsLock.Unlock()
+
+		// Check and reserve in one step, so that simultaneous connections can't all get in
+		if ip_connections[ip.String()] >= RELAY_MAX_CONNECTIONS_PER_IP {
+			return true
+		}
+
+		ip_connections[ip.String()]++
+		ip_reservations[r] = ip.String()
+
+		time.AfterFunc(ipReservationTTL, func() {
+			ip_connectionsLock.Lock()
+			defer ip_connectionsLock.Unlock()
+
+			if addr, ok := ip_reservations[r]; ok {
+				delete(ip_reservations, r)
+				releaseConnection(addr)
+			}
+		})
+	}
+
+	return false
+}
+
+// TrackConnection claims the slot reserved when the connection was accepted
+func TrackConnection(ctx context.Context) {
+	r := khatru.GetConnection(ctx).Request
+
+	ip_connectionsLock.Lock()
+	defer ip_connectionsLock.Unlock()
+
+	if _, ok := ip_reservations[r]; ok {
+		delete(ip_reservations, r)
+	} else if ip := GetClientIP(r); ip != nil {
+		// Either the reservation lapsed, or there is no cap and nothing was reserved
+		ip_connections[ip.String()]++
+	}
+}
+
+func UntrackConnection(ctx context.Context) {
+	if ip := GetClientIP(khatru.GetConnection(ctx).Request); ip != nil {
+		ip_connectionsLock.Lock()
+		releaseConnection(ip.String())
+		ip_connectionsLock.Unlock()
+	}
+}
+
+// releaseConnection must be called with ip_connectionsLock held
+func releaseConnection(addr string) {
+	if ip_connections[addr] <= 1 {
+		delete(ip_connections, addr)
+	} else {
+		ip_connections[addr]--
+	}
+}
+
+// Per-IP rate limits for HTTP endpoints that are expensive to serve, counted in fixed windows
+
+type ipRate struct {
+	count int
+	reset time.Time
+}
+
+var (
+	ip_rates      = make(map[string]*ipRate)
+	ip_ratesSwept time.Time
+	ip_ratesLock  sync.Mutex
+)
+
+// AllowIPRequest counts a request to the endpoint called name against a limit per window for
+// the request's IP address, and reports whether it's within the limit. A limit of zero
+// means unlimited.
+func AllowIPRequest(name string, r *http.Request, limit int, window time.Duration) bool {
+	ip := GetClientIP(r)
+	if limit <= 0 || ip == nil {
+		return limit <= 0
+	}
+
+	key := name + ":" + ip.String()
+	now := time.Now()
+
+	ip_ratesLock.Lock()
+	defer ip_ratesLock.Unlock()
+
+	// Every so often, forget windows that have passed so that one-off visitors don't accumulate
+	if now.Sub(ip_ratesSwept) > time.Minute {
+		for k, v := range ip_rates {
+			if now.After(v.reset) {
+				delete(ip_rates, k)
+			}
+		}
+
+		ip_ratesSwept = now
+	}
+
+	rate, ok := ip_rates[key]
+	if !ok || now.After(rate.reset) {
+		rate = &ipRate{reset: now.Add(window)}
+		ip_rates[key] = rate
+	}
+
+	if rate.count >= limit {
+		return false
+	}
+
+	rate.count++
+
+	return true
+}
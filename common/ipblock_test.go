@@ -0,0 +1,65 @@
+package common
+
+import (
+	"net"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestBlockedRanges(t *testing.T) {
+	ipnet, _ := ParseIPRange("198.51.100.0/24")
+	ip := net.ParseIP("198.51.100.7")
+
+	if IsBlockedIP(ip) {
+		t.Fatalf("expected %s not to be blocked yet", ip)
+	}
+
+	BlockIP(ipnet, "abuse")
+
+	if !IsBlockedIP(ip) || IsBlockedIP(net.ParseIP("198.51.101.7")) {
+		t.Fatalf("expected only addresses in %s to be blocked", ipnet)
+	}
+
+	UnblockIP(ipnet)
+
+	if IsBlockedIP(ip) {
+		t.Fatalf("expected %s to be unblocked", ip)
+	}
+}
+
+func TestConnectionCapIsAtomic(t *testing.T) {
+	defer func(max int) { RELAY_MAX_CONNECTIONS_PER_IP = max }(RELAY_MAX_CONNECTIONS_PER_IP)
+	RELAY_MAX_CONNECTIONS_PER_IP = 2
+
+	var accepted atomic.Int32
+	var wg sync.WaitGroup
+
+	for range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = "192.0.2.10:1234"
+
+			if !RejectConnection(r) {
+				accepted.Add(1)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if n := accepted.Load(); n != 2 {
+		t.Fatalf("expected 2 connections to be accepted, got %d", n)
+	}
+
+	ip_connectionsLock.Lock()
+	for r, addr := range ip_reservations {
+		delete(ip_reservations, r)
+		releaseConnection(addr)
+	}
+	ip_connectionsLock.Unlock()
+}
@@ -0,0 +1,191 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// The relay's own signing key. Unless RELAY_SECRET is set, it's generated once and kept in
+// DATA_DIR, so that relay-authored events remain valid across restarts.
+
+func GetRelaySecretPath() string {
+	return GetDataDir("relay.key")
+}
+
+func GetBunkerClientSecretPath() string {
+	return GetDataDir("bunker-client.key")
+}
+
+func LoadOrCreateRelaySecret() string {
+	return loadOrCreateSecret(GetRelaySecretPath())
+}
+
+func SaveRelaySecret(secret string) error {
+	return saveSecret(GetRelaySecretPath(), secret)
+}
+
+func loadOrCreateSecret(path string) string {
+	if data, err := os.ReadFile(path); err == nil {
+		secret := strings.TrimSpace(string(data))
+
+		if _, err := nostr.GetPublicKey(secret); err != nil {
+			log.Fatalf("Invalid secret in %s: %v", path, err)
+		}
+
+		return secret
+	} else if !os.IsNotExist(err) {
+		log.Fatalf("Failed to read secret from %s: %v", path, err)
+	}
+
+	secret := nostr.GeneratePrivateKey()
+
+	if err := saveSecret(path, secret); err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("Generated a new secret and saved it to %s", path)
+
+	return secret
+}
+
+func saveSecret(path string, secret string) error {
+	if err := os.MkdirAll(DATA_DIR, 0700); err != nil {
+		return fmt.Errorf("failed to create data directory: %w", err)
+	}
+
+	// Write to a temporary file first so that a crash can't leave us without a key
+	tmp := path + ".tmp"
+
+	if err := os.WriteFile(tmp, []byte(secret+"\n"), 0600); err != nil {
+		return fmt.Errorf("failed to write secret: %w", err)
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to write secret: %w", err)
+	}
+
+	return nil
+}
+
+// KeyRotation records a rotation of the relay key which hasn't finished re-signing events
+type KeyRotation struct {
+	From      string          `json:"from"`
+	To        string          `json:"to"`
+	StartedAt nostr.Timestamp `json:"started_at"`
+}
+
+func GetKeyRotation() *KeyRotation {
+	var rotation KeyRotation
+
+	if err := json.Unmarshal(GetItem("keyrotation", "pending"), &rotation); err != nil {
+		return nil
+	}
+
+	return &rotation
+}
+
+// RotateRelaySecret switches the relay to newSecret, then re-signs every event authored by
+// the old key. The new key and the rotation are saved before any events are touched, so an
+// interrupted rotation can be finished with ResumeKeyRotation. The relay must not be running.
+func RotateRelaySecret(ctx context.Context, newSecret string) (int, error) {
+	newSelf, err := nostr.GetPublicKey(newSecret)
+	if err != nil {
+		return 0, fmt.Errorf("invalid secret: %w", err)
+	}
+
+	if rotation := GetKeyRotation(); rotation != nil {
+		return 0, fmt.Errorf("rotation from %s to %s hasn't finished, resume it first", rotation.From, rotation.To)
+	}
+
+	data, err := json.Marshal(KeyRotation{From: RELAY_SELF, To: newSelf, StartedAt: nostr.Now()})
+	if err != nil {
+		return 0, err
+	}
+
+	PutItem("keyrotation", "pending", data)
+
+	if err := SaveRelaySecret(newSecret); err != nil {
+		DeleteItem("keyrotation", "pending")
+		return 0, err
+	}
+
+	signer, _ := newKeySigner(newSecret)
+
+	RELAY_SECRET = newSecret
+	RELAY_SELF = newSelf
+	relay_signer = signer
+
+	return ResumeKeyRotation(ctx)
+}
+
+// ResumeKeyRotation re-signs the events left over from a rotation with the current key,
+// deleting the originals, and forgets the rotation once none are left.
+func ResumeKeyRotation(ctx context.Context) (int, error) {
+	rotation := GetKeyRotation()
+	if rotation == nil {
+		return 0, nil
+	}
+
+	if RELAY_SELF != rotation.To {
+		return 0, fmt.Errorf("relay key is %s rather than %s, check that RELAY_SECRET isn't set to the old key", RELAY_SELF, rotation.To)
+	}
+
+	count := 0
+	filter := nostr.Filter{
+		Authors: []string{rotation.From},
+		Limit:   1000,
+	}
+
+	// Originals are deleted as we go, so just keep querying until there are none left
+	for {
+		ch, err := GetBackend().QueryEvents(ctx, filter)
+		if err != nil {
+			return count, fmt.Errorf("failed to query events: %w", err)
+		}
+
+		events := make([]*nostr.Event, 0)
+		for event := range ch {
+			events = append(events, event)
+		}
+
+		if len(events) == 0 {
+			break
+		}
+
+		for _, event := range events {
+			resigned := &nostr.Event{
+				Kind:      event.Kind,
+				CreatedAt: event.CreatedAt,
+				Tags:      event.Tags,
+				Content:   event.Content,
+			}
+
+			if err := resigned.Sign(RELAY_SECRET); err != nil {
+				return count, fmt.Errorf("failed to sign event %s: %w", event.ID, err)
+			}
+
+			// The re-signed event may already have been saved before an interruption
+			if err := GetBackend().SaveEvent(ctx, resigned); err != nil && !errors.Is(err, eventstore.ErrDupEvent) {
+				return count, fmt.Errorf("failed to save event %s: %w", resigned.ID, err)
+			}
+
+			if err := GetBackend().DeleteEvent(ctx, event); err != nil {
+				return count, fmt.Errorf("failed to delete event %s: %w", event.ID, err)
+			}
+
+			count++
+		}
+	}
+
+	DeleteItem("keyrotation", "pending")
+
+	return count, nil
+}
@@ -0,0 +1,87 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func countEventsBy(t *testing.T, pubkey string) int {
+	ch, err := GetBackend().QueryEvents(context.Background(), nostr.Filter{Authors: []string{pubkey}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	count := 0
+	for range ch {
+		count++
+	}
+
+	return count
+}
+
+func TestRotateRelaySecret(t *testing.T) {
+	ctx := context.Background()
+	oldSelf := RELAY_SELF
+
+	for i := range 3 {
+		event := &nostr.Event{Kind: 39000, CreatedAt: nostr.Now(), Tags: nostr.Tags{{"d", RandomString(8)}}, Content: string(rune('a' + i))}
+		if err := SignAsRelay(event); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := GetBackend().SaveEvent(ctx, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	count, err := RotateRelaySecret(ctx, nostr.GeneratePrivateKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count != 3 || countEventsBy(t, oldSelf) != 0 || countEventsBy(t, RELAY_SELF) != 3 {
+		t.Fatalf("expected 3 events to be re-signed, got %d", count)
+	}
+
+	if GetKeyRotation() != nil {
+		t.Fatalf("rotation still pending after finishing")
+	}
+
+	if LoadOrCreateRelaySecret() != RELAY_SECRET {
+		t.Fatalf("new secret was not saved")
+	}
+}
+
+func TestResumeKeyRotation(t *testing.T) {
+	ctx := context.Background()
+	oldSecret, oldSelf := testKeypair()
+
+	// Pretend a rotation away from oldSelf was interrupted after saving the new key
+	event := &nostr.Event{Kind: 39000, CreatedAt: nostr.Now(), Tags: nostr.Tags{{"d", RandomString(8)}}}
+	if err := event.Sign(oldSecret); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := GetBackend().SaveEvent(ctx, event); err != nil {
+		t.Fatal(err)
+	}
+
+	data, _ := json.Marshal(KeyRotation{From: oldSelf, To: RELAY_SELF, StartedAt: nostr.Now()})
+	PutItem("keyrotation", "pending", data)
+
+	if _, err := RotateRelaySecret(ctx, nostr.GeneratePrivateKey()); err == nil {
+		t.Fatalf("expected a new rotation to be refused while one is pending")
+	}
+
+	count, err := ResumeKeyRotation(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count != 1 || countEventsBy(t, oldSelf) != 0 || GetKeyRotation() != nil {
+		t.Fatalf("expected the interrupted rotation to finish, re-signed %d events", count)
+	}
+}
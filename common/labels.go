@@ -0,0 +1,400 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Moderation labels attached to events and pubkeys, published as relay-signed NIP 32 label
+// events under RELAY_LABEL_NAMESPACE. Each target has a single label event listing all of its
+// labels, which is generated on demand rather than stored.
+
+const (
+	LABEL_TARGET_EVENT  = "event"
+	LABEL_TARGET_PUBKEY = "pubkey"
+)
+
+var label_lock sync.Mutex
+
+// Signed label events are cached by id, since they're regenerated for every subscription
+var (
+	label_signatures     = make(map[string]string)
+	label_signaturesLock sync.Mutex
+)
+
+const LABEL_SIGNATURE_CACHE_SIZE = 10000
+
+type Labels struct {
+	Target     string          `json:"target"`
+	TargetType string          `json:"target_type"`
+	Group      string          `json:"group,omitempty"`
+	Labels     []string        `json:"labels"`
+	Reason     string          `json:"reason,omitempty"`
+	UpdatedAt  nostr.Timestamp `json:"updated_at"`
+}
+
+// ParseLabels normalizes labels given by a moderator, which are case-insensitive
+func ParseLabels(labels []string) ([]string, error) {
+	result := make([]string, 0, len(labels))
+
+	for _, label := range labels {
+		label = strings.ToLower(strings.TrimSpace(label))
+		if label == "" {
+			return nil, fmt.Errorf("labels cannot be empty")
+		}
+
+		if !slices.Contains(result, label) {
+			result = append(result, label)
+		}
+	}
+
+	return result, nil
+}
+
+func GetLabels(target string) *Labels {
+	var labels Labels
+
+	if err := json.Unmarshal(GetItem("label", target), &labels); err != nil {
+		return nil
+	}
+
+	return &labels
+}
+
+func PutLabels(labels Labels) {
+	if len(labels.Labels) == 0 {
+		DeleteItem("label", labels.Target)
+		return
+	}
+
+	data, err := json.Marshal(labels)
+	if err != nil {
+		log.Println(err)
+	} else {
+		PutItem("label", labels.Target, data)
+	}
+}
+
+func ListLabels() []Labels {
+	result := make([]Labels, 0)
+
+	for _, item := range ListItems("label") {
+		var labels Labels
+
+		if err := json.Unmarshal([]byte(item), &labels); err != nil {
+			log.Printf("Failed to unmarshal labels %v %s", err, item)
+			continue
+		}
+
+		result = append(result, labels)
+	}
+
+	return result
+}
+
+// AddLabels attaches labels to an event or pubkey, and publishes the updated label event
+func AddLabels(target string, targetType string, labels []string, reason string) Labels {
+	label_lock.Lock()
+	defer label_lock.Unlock()
+
+	current := GetLabels(target)
+	if current == nil {
+		current = &Labels{Target: target, TargetType: targetType}
+	}
+
+	// Remember the labelled event's group, so its labels stay as private as the event
+	if current.TargetType == LABEL_TARGET_EVENT && current.Group == "" {
+		current.Group = findLabelledGroup(target)
+	}
+
+	for _, label := range labels {
+		if !slices.Contains(current.Labels, label) {
+			current.Labels = append(current.Labels, label)
+		}
+	}
+
+	if reason != "" {
+		current.Reason = reason
+	}
+
+	current.UpdatedAt = nostr.Now()
+
+	PutLabels(*current)
+	broadcastLabelEvent(*current)
+
+	return *current
+}
+
+// RemoveLabels removes the given labels from an event or pubkey, or all of them if none are given
+func RemoveLabels(target string, labels []string) {
+	label_lock.Lock()
+	defer label_lock.Unlock()
+
+	current := GetLabels(target)
+	if current == nil {
+		return
+	}
+
+	if len(labels) == 0 {
+		current.Labels = nil
+	} else {
+		current.Labels = Filter(current.Labels, func(label string) bool {
+			return !slices.Contains(labels, label)
+		})
+	}
+
+	current.UpdatedAt = nostr.Now()
+
+	PutLabels(*current)
+	broadcastLabelEvent(*current)
+}
+
+// GetEventLabels returns the labels attached to an event, along with those attached to its author
+func GetEventLabels(event *nostr.Event) []string {
+	result := make([]string, 0)
+
+	for _, target := range []string{event.ID, event.PubKey} {
+		if labels := GetLabels(target); labels != nil {
+			result = append(result, labels.Labels...)
+		}
+	}
+
+	return result
+}
+
+// MakeLabelEvent builds the label event for a target. Once every label has been removed, an
+// event with no labels is broadcast so that live subscribers can drop the old ones.
+func MakeLabelEvent(labels Labels) *nostr.Event {
+	event := nostr.Event{
+		Kind:      nostr.KindLabel,
+		CreatedAt: labels.UpdatedAt,
+		Content:   labels.Reason,
+		Tags: nostr.Tags{
+			nostr.Tag{"L", RELAY_LABEL_NAMESPACE},
+		},
+	}
+
+	for _, label := range labels.Labels {
+		event.Tags = append(event.Tags, nostr.Tag{"l", label, RELAY_LABEL_NAMESPACE})
+	}
+
+	if labels.TargetType == LABEL_TARGET_EVENT {
+		event.Tags = append(event.Tags, nostr.Tag{"e", labels.Target})
+	} else {
+		event.Tags = append(event.Tags, nostr.Tag{"p", labels.Target})
+	}
+
+	return &event
+}
+
+func signLabelEvent(event *nostr.Event) error {
+	event.PubKey = RELAY_SELF
+	event.ID = event.GetID()
+
+	label_signaturesLock.Lock()
+	sig, ok := label_signatures[event.ID]
+	label_signaturesLock.Unlock()
+
+	if ok {
+		event.Sig = sig
+		return nil
+	}
+
+	if err := SignAsRelay(event); err != nil {
+		return err
+	}
+
+	label_signaturesLock.Lock()
+	defer label_signaturesLock.Unlock()
+
+	if len(label_signatures) >= LABEL_SIGNATURE_CACHE_SIZE {
+		clear(label_signatures)
+	}
+
+	label_signatures[event.ID] = event.Sig
+
+	return nil
+}
+
+func broadcastLabelEvent(labels Labels) {
+	event := MakeLabelEvent(labels)
+
+	if err := signLabelEvent(event); err != nil {
+		log.Println("Failed to sign label event", err)
+	} else {
+		GetRelay().BroadcastEvent(event)
+	}
+}
+
+// findLabelledGroup returns the group a labelled event was published to, if it's still around
+func findLabelledGroup(id string) string {
+	events, err := GetBackend().QueryEvents(context.Background(), nostr.Filter{IDs: []string{id}})
+	if err != nil {
+		log.Println(err)
+		return ""
+	}
+
+	h := ""
+	for event := range events {
+		h = GetGroupIDFromEvent(event)
+	}
+
+	return h
+}
+
+// getLabelledGroup returns the group of a labelled event, looking it up for labels that were
+// added before groups were recorded
+func getLabelledGroup(labels Labels) string {
+	if labels.Group != "" || labels.TargetType != LABEL_TARGET_EVENT {
+		return labels.Group
+	}
+
+	return findLabelledGroup(labels.Target)
+}
+
+// CanSeeLabels applies the visibility of the labelled event to its labels, so that labels on
+// events in private groups are only shown to members
+func CanSeeLabels(ctx context.Context, pubkey string, labels Labels) bool {
+	h := getLabelledGroup(labels)
+	if h == "" || slices.Contains(RELAY_ADMINS, pubkey) {
+		return true
+	}
+
+	g := GetGroup(h)
+
+	return g == nil || !g.Private || IsGroupMember(ctx, h, pubkey)
+}
+
+func GenerateLabelEvents(ctx context.Context, filter nostr.Filter) []*nostr.Event {
+	result := make([]*nostr.Event, 0)
+	pubkey := khatru.GetAuthed(ctx)
+
+	if len(filter.Authors) > 0 && !slices.Contains(filter.Authors, RELAY_SELF) {
+		return result
+	}
+
+	// Look up the requested targets directly rather than reading the whole table
+	var candidates []Labels
+	if targets := append(slices.Clone(filter.Tags["e"]), filter.Tags["p"]...); len(targets) > 0 {
+		for _, target := range targets {
+			if labels := GetLabels(target); labels != nil {
+				candidates = append(candidates, *labels)
+			}
+		}
+	} else {
+		candidates = ListLabels()
+	}
+
+	slices.SortFunc(candidates, func(a, b Labels) int {
+		return int(b.UpdatedAt) - int(a.UpdatedAt)
+	})
+
+	for _, labels := range candidates {
+		if filter.Limit > 0 && len(result) >= filter.Limit {
+			break
+		}
+
+		event := MakeLabelEvent(labels)
+		event.PubKey = RELAY_SELF
+
+		if !filter.Matches(event) || !CanSeeLabels(ctx, pubkey, labels) {
+			continue
+		}
+
+		if err := signLabelEvent(event); err != nil {
+			log.Println("Failed to sign label event", err)
+		} else {
+			result = append(result, event)
+		}
+	}
+
+	return result
+}
+
+// PreventLabelBroadcast keeps label events about events in private groups from non-members
+func PreventLabelBroadcast(ws *khatru.WebSocket, event *nostr.Event) bool {
+	if event.Kind != nostr.KindLabel || event.PubKey != RELAY_SELF {
+		return false
+	}
+
+	tag := event.Tags.GetFirst([]string{"e", ""})
+	if tag == nil {
+		return false
+	}
+
+	labels := GetLabels(tag.Value())
+	if labels == nil {
+		// Every label was removed, so fall back to the event itself
+		labels = &Labels{Target: tag.Value(), TargetType: LABEL_TARGET_EVENT}
+	}
+
+	return !CanSeeLabels(ws.Context, ws.AuthedPublicKey, *labels)
+}
+
+// Group label rules list labels that aren't welcome in a group. Events carrying one of them,
+// or written by a pubkey carrying one of them, are hidden from the group, and labelled pubkeys
+// can't publish to it.
+
+func GetGroupLabelRules(h string) []string {
+	var labels []string
+
+	if data := GetItem("grouplabelrules", h); data != nil {
+		if err := json.Unmarshal(data, &labels); err != nil {
+			log.Printf("Failed to unmarshal group label rules %v %s", err, data)
+		}
+	}
+
+	return labels
+}
+
+func SetGroupLabelRules(h string, labels []string) {
+	if len(labels) == 0 {
+		DeleteItem("grouplabelrules", h)
+		return
+	}
+
+	data, err := json.Marshal(labels)
+	if err != nil {
+		log.Println(err)
+	} else {
+		PutItem("grouplabelrules", h, data)
+	}
+}
+
+func ListGroupLabelRules() map[string][]string {
+	rules := make(map[string][]string)
+
+	for h := range ListItems("grouplabelrules") {
+		rules[h] = GetGroupLabelRules(h)
+	}
+
+	return rules
+}
+
+// GetBlockedGroupLabel returns the first label that keeps an event out of group h, if any
+func GetBlockedGroupLabel(h string, event *nostr.Event) string {
+	rules := GetGroupLabelRules(h)
+	if len(rules) == 0 {
+		return ""
+	}
+
+	return findBlockedLabel(rules, GetEventLabels(event))
+}
+
+func findBlockedLabel(rules []string, labels []string) string {
+	for _, label := range labels {
+		if slices.Contains(rules, label) {
+			return label
+		}
+	}
+
+	return ""
+}
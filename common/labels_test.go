@@ -0,0 +1,93 @@
+package common
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestLabelsFollowGroupVisibility(t *testing.T) {
+	ctx := context.Background()
+	authorSecret, author := testKeypair()
+	_, outsider := testKeypair()
+
+	h := RandomString(8)
+	group := MakeGroup(h)
+	group.Private = true
+	PutGroup(group)
+	defer DeleteGroup(h)
+
+	event := &nostr.Event{
+		Kind:      nostr.KindSimpleGroupChatMessage,
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{{"h", h}},
+	}
+	event.Sign(authorSecret)
+
+	if err := GetBackend().SaveEvent(ctx, event); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := GetBackend().SaveEvent(ctx, MakePutUserEvent(event)); err != nil {
+		t.Fatal(err)
+	}
+
+	labels := AddLabels(event.ID, LABEL_TARGET_EVENT, []string{"spam"}, "")
+	defer RemoveLabels(event.ID, nil)
+
+	if labels.Group != h {
+		t.Fatalf("expected labels to record group %s, got %q", h, labels.Group)
+	}
+
+	if !CanSeeLabels(ctx, author, labels) || !CanSeeLabels(ctx, testAdmin, labels) {
+		t.Fatalf("members and admins should see labels on private group events")
+	}
+
+	if CanSeeLabels(ctx, outsider, labels) {
+		t.Fatalf("non-members should not see labels on private group events")
+	}
+
+	// Unauthenticated requests are treated as non-members
+	filter := nostr.Filter{Kinds: []int{nostr.KindLabel}, Tags: nostr.TagMap{"e": []string{event.ID}}}
+	if events := GenerateLabelEvents(ctx, filter); len(events) != 0 {
+		t.Fatalf("expected no label events for a non-member, got %d", len(events))
+	}
+}
+
+func TestGenerateLabelEventsLimit(t *testing.T) {
+	targets := make([]string, 0)
+
+	for range 3 {
+		_, pubkey := testKeypair()
+		AddLabels(pubkey, LABEL_TARGET_PUBKEY, []string{"spam"}, "")
+		targets = append(targets, pubkey)
+	}
+
+	defer func() {
+		for _, target := range targets {
+			RemoveLabels(target, nil)
+		}
+	}()
+
+	events := GenerateLabelEvents(context.Background(), nostr.Filter{Kinds: []int{nostr.KindLabel}, Limit: 2})
+	if len(events) != 2 {
+		t.Fatalf("expected the limit to be respected, got %d events", len(events))
+	}
+
+	filter := nostr.Filter{Kinds: []int{nostr.KindLabel}, Tags: nostr.TagMap{"p": targets[:1]}}
+
+	events = GenerateLabelEvents(context.Background(), filter)
+	if len(events) != 1 || events[0].Tags.GetFirst([]string{"p", targets[0]}) == nil {
+		t.Fatalf("expected the label event for the requested pubkey, got %v", events)
+	}
+
+	if ok, _ := events[0].CheckSignature(); !ok {
+		t.Fatalf("expected label events to be signed by the relay")
+	}
+
+	// Signatures are reused for identical label events
+	if again := GenerateLabelEvents(context.Background(), filter); again[0].Sig != events[0].Sig {
+		t.Fatalf("expected the cached signature to be reused")
+	}
+}
@@ -0,0 +1,39 @@
+package common
+
+import (
+	"log"
+	"os"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+var (
+	testAdminSecret = nostr.GeneratePrivateKey()
+	testAdmin, _    = nostr.GetPublicKey(testAdminSecret)
+)
+
+// TestMain runs the tests against a throwaway data directory, with a single relay admin
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "frith-test")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	os.Setenv("DATA_DIR", dir)
+	os.Setenv("RELAY_ADMINS", testAdmin)
+
+	SetupEnvironment()
+
+	code := m.Run()
+
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func testKeypair() (string, string) {
+	secret := nostr.GeneratePrivateKey()
+	pubkey, _ := nostr.GetPublicKey(secret)
+
+	return secret, pubkey
+}
@@ -0,0 +1,150 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+)
+
+// Moderators are granted a subset of the NIP 86 methods available to relay admins. Each grant
+// is either the name of a permission set below or the name of a single method. Report actions
+// which aren't methods of their own, such as removefromgroup, are granted the same way.
+
+var MODERATOR_PERMISSIONS = map[string][]string{
+	"banpubkey":    {"banpubkey", "tempbanpubkey", "unbanpubkey", "listbannedpubkeys", "shadowbanpubkey", "unshadowbanpubkey", "listshadowbannedpubkeys"},
+	"banevent":     {"banevent", "allowevent", "listbannedevents"},
+	"purge":        {"purgepubkey"},
+	"blockip":      {"blockip", "unblockip", "listblockedips"},
+	"invites":      {"listinvites", "rotateinvite", "setinvitequota", "listinvitetree"},
+	"members":      {"allowpubkey", "disallowpubkey", "listallowedpubkeys", "listdisallowedpubkeys", "revokepubkey", "listrevokedpubkeys", "listflaggedpubkeys", "unflagpubkey", "listclaims", "renewclaim"},
+	"applications": {"listapplications", "approveapplication", "denyapplication"},
+	"reports":      {"listreports", "resolvereport"},
+	"groups":       {"removefromgroup"},
+	"info":         {"changerelayname", "changerelaydescription", "changerelayicon"},
+	"labels":       {"labelevent", "unlabelevent", "labelpubkey", "unlabelpubkey", "listlabels", "setgrouplabelrules", "listgrouplabelrules"},
+}
+
+type Moderator struct {
+	PubKey      string   `json:"pubkey"`
+	Permissions []string `json:"permissions"`
+}
+
+func IsValidPermission(permission string) bool {
+	if _, ok := MODERATOR_PERMISSIONS[permission]; ok {
+		return true
+	}
+
+	for _, methods := range MODERATOR_PERMISSIONS {
+		if slices.Contains(methods, permission) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func GetModeratorPermissions(pubkey string) []string {
+	var permissions []string
+
+	if data := GetItem("moderator", pubkey); data != nil {
+		if err := json.Unmarshal(data, &permissions); err != nil {
+			log.Printf("Failed to unmarshal moderator permissions %v %s", err, data)
+		}
+	}
+
+	return permissions
+}
+
+func PutModeratorPermissions(pubkey string, permissions []string) {
+	if len(permissions) == 0 {
+		DeleteItem("moderator", pubkey)
+		return
+	}
+
+	data, err := json.Marshal(permissions)
+	if err != nil {
+		log.Println(err)
+	} else {
+		PutItem("moderator", pubkey, data)
+	}
+}
+
+func ListModerators() []Moderator {
+	moderators := make([]Moderator, 0)
+
+	for pubkey := range ListItems("moderator") {
+		moderators = append(moderators, Moderator{
+			PubKey:      pubkey,
+			Permissions: GetModeratorPermissions(pubkey),
+		})
+	}
+
+	return moderators
+}
+
+func GrantModerator(pubkey string, permissions []string) error {
+	for _, permission := range permissions {
+		if !IsValidPermission(permission) {
+			return fmt.Errorf("unknown permission '%s', expected one of %v or a method they include", permission, slices.Sorted(maps.Keys(MODERATOR_PERMISSIONS)))
+		}
+	}
+
+	current := GetModeratorPermissions(pubkey)
+
+	for _, permission := range permissions {
+		if !slices.Contains(current, permission) {
+			current = append(current, permission)
+		}
+	}
+
+	PutModeratorPermissions(pubkey, current)
+
+	return nil
+}
+
+// RevokeModerator removes the given permissions, or all of them if none are given
+func RevokeModerator(pubkey string, permissions []string) {
+	if len(permissions) == 0 {
+		PutModeratorPermissions(pubkey, nil)
+		return
+	}
+
+	PutModeratorPermissions(pubkey, Filter(GetModeratorPermissions(pubkey), func(permission string) bool {
+		return !slices.Contains(permissions, permission)
+	}))
+}
+
+// CanModerate reports whether actor may take action against target. Only relay admins can act
+// against other admins or moderators.
+func CanModerate(actor string, target string) bool {
+	if slices.Contains(RELAY_ADMINS, actor) {
+		return true
+	}
+
+	return !slices.Contains(RELAY_ADMINS, target) && len(GetModeratorPermissions(target)) == 0
+}
+
+func checkModerationTarget(ctx context.Context, target string) error {
+	if !CanModerate(getManagementAuthed(ctx), target) {
+		return fmt.Errorf("blocked: only relay admins can act against admins or moderators")
+	}
+
+	return nil
+}
+
+func CanCallMethod(pubkey string, method string) bool {
+	if slices.Contains(RELAY_ADMINS, pubkey) {
+		return true
+	}
+
+	for _, permission := range GetModeratorPermissions(pubkey) {
+		if permission == method || slices.Contains(MODERATOR_PERMISSIONS[permission], method) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,231 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip05"
+)
+
+// Access granted to pubkeys whose profile claims a verified NIP 05 identifier on one of
+// RELAY_NIP05_DOMAINS. Verification results are stored in the database and rechecked once
+// they are older than RELAY_NIP05_TTL. Checks always happen in the background so that a slow
+// domain can't hold up a request, and pubkeys are denied until their first check finishes.
+
+// How long to wait for a domain to answer a NIP 05 check
+const NIP05_TIMEOUT = 10 * time.Second
+
+type NIP05Verification struct {
+	Identifier string          `json:"identifier"`
+	Valid      bool            `json:"valid"`
+	CheckedAt  nostr.Timestamp `json:"checked_at"`
+}
+
+var (
+	nip05_pending    = make(map[string]bool)
+	nip05_pending_mu sync.Mutex
+)
+
+func HasAccessUsingNIP05(pubkey string) bool {
+	if len(RELAY_NIP05_DOMAINS) == 0 || pubkey == "" {
+		return false
+	}
+
+	verification, ok := GetNIP05Verification(pubkey)
+
+	if ok && verification.CheckedAt.Time().Add(RELAY_NIP05_TTL).After(time.Now()) {
+		return verification.Valid
+	}
+
+	go VerifyNIP05(pubkey)
+
+	return ok && verification.Valid
+}
+
+func GetNIP05Verification(pubkey string) (NIP05Verification, bool) {
+	var verification NIP05Verification
+
+	data := GetItem("nip05", pubkey)
+	if data == nil {
+		return verification, false
+	}
+
+	if err := json.Unmarshal(data, &verification); err != nil {
+		return verification, false
+	}
+
+	return verification, true
+}
+
+func PutNIP05Verification(pubkey string, verification NIP05Verification) {
+	data, err := json.Marshal(verification)
+	if err != nil {
+		log.Println(err)
+	} else {
+		PutItem("nip05", pubkey, data)
+	}
+}
+
+// HandleProfile rechecks a pubkey's identifier as soon as their profile changes
+func HandleProfile(event *nostr.Event) {
+	if len(RELAY_NIP05_DOMAINS) > 0 {
+		go VerifyNIP05(event.PubKey)
+	}
+}
+
+// VerifyNIP05 checks the identifier in the pubkey's latest profile and stores the result.
+// Only one check per pubkey runs at a time; concurrent callers get the stored result.
+func VerifyNIP05(pubkey string) NIP05Verification {
+	nip05_pending_mu.Lock()
+	if nip05_pending[pubkey] {
+		nip05_pending_mu.Unlock()
+		verification, _ := GetNIP05Verification(pubkey)
+
+		return verification
+	}
+
+	nip05_pending[pubkey] = true
+	nip05_pending_mu.Unlock()
+
+	defer func() {
+		nip05_pending_mu.Lock()
+		delete(nip05_pending, pubkey)
+		nip05_pending_mu.Unlock()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), NIP05_TIMEOUT)
+	defer cancel()
+
+	verification := NIP05Verification{
+		Identifier: getProfileNIP05(ctx, pubkey),
+		CheckedAt:  nostr.Now(),
+	}
+
+	if verification.Identifier != "" {
+		valid, err := checkNIP05(ctx, verification.Identifier, pubkey)
+		if err != nil {
+			log.Printf("failed to verify nip05 %s: %v", verification.Identifier, err)
+
+			// Don't revoke access just because a domain is briefly unreachable
+			if previous, ok := GetNIP05Verification(pubkey); ok && previous.Identifier == verification.Identifier {
+				valid = previous.Valid
+			}
+		}
+
+		verification.Valid = valid
+	}
+
+	PutNIP05Verification(pubkey, verification)
+
+	return verification
+}
+
+func getProfileNIP05(ctx context.Context, pubkey string) string {
+	ch, err := GetBackend().QueryEvents(ctx, nostr.Filter{
+		Kinds:   []int{nostr.KindProfileMetadata},
+		Authors: []string{pubkey},
+	})
+	if err != nil {
+		log.Println(err)
+		return ""
+	}
+
+	var latest *nostr.Event
+	for event := range ch {
+		if latest == nil || latest.CreatedAt < event.CreatedAt {
+			latest = event
+		}
+	}
+
+	if latest == nil {
+		return ""
+	}
+
+	var profile struct {
+		NIP05 string `json:"nip05"`
+	}
+
+	if err := json.Unmarshal([]byte(latest.Content), &profile); err != nil {
+		return ""
+	}
+
+	return strings.ToLower(strings.TrimSpace(profile.NIP05))
+}
+
+func parseNIP05(identifier string) (string, string) {
+	name, domain, found := strings.Cut(identifier, "@")
+	if !found {
+		return "_", name
+	}
+
+	return name, domain
+}
+
+func checkNIP05(ctx context.Context, identifier string, pubkey string) (bool, error) {
+	name, domain := parseNIP05(identifier)
+
+	if name == "" || !slices.Contains(RELAY_NIP05_DOMAINS, domain) {
+		return false, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", getNIP05URL(domain, name), nil)
+	if err != nil {
+		return false, err
+	}
+
+	// Redirects aren't allowed by NIP 05
+	client := &http.Client{
+		Timeout: NIP05_TIMEOUT,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode >= 500 {
+		return false, fmt.Errorf("%s responded with status %d", domain, res.StatusCode)
+	}
+
+	if res.StatusCode != 200 {
+		return false, nil
+	}
+
+	var result nip05.WellKnownResponse
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return false, nil
+	}
+
+	return result.Names[name] == pubkey, nil
+}
+
+// getNIP05URL uses plain http for loopback hosts, which makes it possible to verify against
+// a stand-in server during development. Every other domain, including IP addresses, uses https.
+func getNIP05URL(domain string, name string) string {
+	scheme := "https"
+	host, _, err := net.SplitHostPort(domain)
+	if err != nil {
+		host = domain
+	}
+
+	if ip := net.ParseIP(host); host == "localhost" || (ip != nil && ip.IsLoopback()) {
+		scheme = "http"
+	}
+
+	return fmt.Sprintf("%s://%s/.well-known/nostr.json?name=%s", scheme, domain, url.QueryEscape(name))
+}
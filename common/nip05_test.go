@@ -0,0 +1,112 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestGetNIP05URL(t *testing.T) {
+	cases := map[string]string{
+		"example.com":    "https://example.com/.well-known/nostr.json?name=bob",
+		"localhost:8080": "http://localhost:8080/.well-known/nostr.json?name=bob",
+		"127.0.0.1:8080": "http://127.0.0.1:8080/.well-known/nostr.json?name=bob",
+		"[::1]:8080":     "http://[::1]:8080/.well-known/nostr.json?name=bob",
+		"10.0.0.1":       "https://10.0.0.1/.well-known/nostr.json?name=bob",
+		"203.0.113.7:80": "https://203.0.113.7:80/.well-known/nostr.json?name=bob",
+	}
+
+	for domain, expected := range cases {
+		if actual := getNIP05URL(domain, "bob"); actual != expected {
+			t.Errorf("getNIP05URL(%s) = %s, expected %s", domain, actual, expected)
+		}
+	}
+}
+
+func TestCheckNIP05(t *testing.T) {
+	_, pubkey := testKeypair()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/.well-known/nostr.json" {
+			http.NotFound(w, r)
+			return
+		}
+
+		names := map[string]string{}
+		if r.URL.Query().Get("name") == "bob" {
+			names["bob"] = pubkey
+		}
+
+		json.NewEncoder(w).Encode(map[string]any{"names": names})
+	}))
+	defer server.Close()
+
+	domain := strings.TrimPrefix(server.URL, "http://")
+
+	defer func(domains []string) { RELAY_NIP05_DOMAINS = domains }(RELAY_NIP05_DOMAINS)
+	RELAY_NIP05_DOMAINS = []string{domain}
+
+	ctx := context.Background()
+
+	if valid, err := checkNIP05(ctx, "bob@"+domain, pubkey); err != nil || !valid {
+		t.Errorf("expected bob to be valid, got %v %v", valid, err)
+	}
+
+	if valid, err := checkNIP05(ctx, "alice@"+domain, pubkey); err != nil || valid {
+		t.Errorf("expected alice to be invalid, got %v %v", valid, err)
+	}
+
+	if valid, _ := checkNIP05(ctx, "bob@example.com", pubkey); valid {
+		t.Errorf("expected identifiers outside RELAY_NIP05_DOMAINS to be invalid")
+	}
+}
+
+func TestNIP05VerifiesInBackground(t *testing.T) {
+	secret, pubkey := testKeypair()
+	release := make(chan struct{})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+
+		json.NewEncoder(w).Encode(map[string]any{"names": map[string]string{"bob": pubkey}})
+	}))
+	defer server.Close()
+
+	domain := strings.TrimPrefix(server.URL, "http://")
+
+	defer func(domains []string) { RELAY_NIP05_DOMAINS = domains }(RELAY_NIP05_DOMAINS)
+	RELAY_NIP05_DOMAINS = []string{domain}
+
+	profile := &nostr.Event{Kind: nostr.KindProfileMetadata, CreatedAt: nostr.Now(), Content: `{"nip05":"bob@` + domain + `"}`}
+	profile.Sign(secret)
+
+	if err := GetBackend().SaveEvent(context.Background(), profile); err != nil {
+		t.Fatal(err)
+	}
+
+	defer GetBackend().DeleteEvent(context.Background(), profile)
+	defer DeleteItem("nip05", pubkey)
+
+	// The domain hasn't answered yet, so access is denied without waiting for it
+	if HasAccessUsingNIP05(pubkey) {
+		t.Fatalf("expected access to be denied until the identifier is verified")
+	}
+
+	close(release)
+
+	for range 100 {
+		if HasAccessUsingNIP05(pubkey) {
+			return
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("expected access to be granted once the identifier is verified")
+}
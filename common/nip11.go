@@ -0,0 +1,45 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// go-nostr's relay information document doesn't have a self field yet, so capture khatru's
+// NIP 11 response and add the relay's pubkey to it on the way out.
+
+type nip11Recorder struct {
+	http.ResponseWriter
+	body bytes.Buffer
+}
+
+func (r *nip11Recorder) Write(b []byte) (int, error) {
+	return r.body.Write(b)
+}
+
+func WithRelaySelf(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		isNIP11 := r.Header.Get("Upgrade") != "websocket" &&
+			strings.Contains(r.Header.Get("Accept"), "application/nostr+json")
+
+		if !isNIP11 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		rec := &nip11Recorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		var info map[string]any
+		if err := json.Unmarshal(rec.body.Bytes(), &info); err != nil {
+			w.Write(rec.body.Bytes())
+			return
+		}
+
+		info["self"] = RELAY_SELF
+
+		json.NewEncoder(w).Encode(info)
+	})
+}
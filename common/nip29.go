@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"slices"
 
 	"github.com/nbd-wtf/go-nostr"
 	"github.com/nbd-wtf/go-nostr/nip29"
@@ -109,11 +110,26 @@ func IsGroupMember(ctx context.Context, h string, pubkey string) bool {
 	return false
 }
 
+// Members allowed to create groups administer the groups they create, alongside relay admins
+
+func GetGroupCreator(h string) string {
+	return string(GetItem("groupcreator", h))
+}
+
+func IsGroupAdmin(h string, pubkey string) bool {
+	if slices.Contains(RELAY_ADMINS, pubkey) {
+		return true
+	}
+
+	return pubkey != "" && h != "" && GetGroupCreator(h) == pubkey
+}
+
 func HandleCreateGroup(event *nostr.Event) {
 	group := MakeGroup(GetGroupIDFromEvent(event))
 
 	if group != nil {
 		PutGroup(group)
+		PutItem("groupcreator", group.Address.ID, []byte(event.PubKey))
 	}
 }
 
@@ -152,6 +168,7 @@ func HandleDeleteGroup(event *nostr.Event) {
 	id := GetGroupIDFromEvent(event)
 
 	DeleteGroup(id)
+	DeleteItem("groupcreator", id)
 
 	hFilter := nostr.Filter{
 		Tags: nostr.TagMap{
@@ -194,7 +211,7 @@ func GenerateGroupMetadataEvents(ctx context.Context, filter nostr.Filter) []*no
 			continue
 		}
 
-		if err := event.Sign(RELAY_SECRET); err != nil {
+		if err := SignAsRelay(event); err != nil {
 			log.Println("Failed to sign metadata event", err)
 		} else {
 			result = append(result, event)
@@ -220,11 +237,15 @@ func GenerateGroupAdminsEvents(ctx context.Context, filter nostr.Filter) []*nost
 			event.Tags = append(event.Tags, nostr.Tag{"p", pubkey})
 		}
 
+		if creator := GetGroupCreator(group.Address.ID); creator != "" && !slices.Contains(RELAY_ADMINS, creator) {
+			event.Tags = append(event.Tags, nostr.Tag{"p", creator})
+		}
+
 		if !filter.Matches(&event) {
 			continue
 		}
 
-		if err := event.Sign(RELAY_SECRET); err != nil {
+		if err := SignAsRelay(&event); err != nil {
 			log.Println("Failed to sign admins event", err)
 		} else {
 			result = append(result, &event)
@@ -244,7 +265,7 @@ func MakePutUserEvent(event *nostr.Event) *nostr.Event {
 		},
 	}
 
-	if err := putUser.Sign(RELAY_SECRET); err != nil {
+	if err := SignAsRelay(&putUser); err != nil {
 		log.Println(err)
 	}
 
@@ -261,7 +282,7 @@ func MakeRemoveUserEvent(event *nostr.Event) *nostr.Event {
 		},
 	}
 
-	if err := removeUser.Sign(RELAY_SECRET); err != nil {
+	if err := SignAsRelay(&removeUser); err != nil {
 		log.Println(err)
 	}
 
@@ -0,0 +1,132 @@
+package common
+
+import (
+	"context"
+	"log"
+	"slices"
+	"sync"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// NIP 43 relay membership. The relay publishes a signed list of its members, along with an
+// event whenever someone is added or removed. The published state is tracked in the "member"
+// table so that changes can be detected no matter how access was granted or revoked.
+
+const (
+	KindMembershipList = 13534
+	KindAddMember      = 8000
+	KindRemoveMember   = 8001
+	AUTH_LEAVE         = 28936
+)
+
+var membershipMu sync.Mutex
+
+// IsMember checks whether pubkey has been explicitly granted access, as opposed to access
+// derived from an external source like the auth backend or web of trust. Revoked pubkeys
+// aren't members, even if they're still whitelisted.
+func IsMember(pubkey string) bool {
+	return !IsRevoked(pubkey) && (HasAccessUsingClaim(pubkey) || HasAccessUsingWhitelist(pubkey))
+}
+
+func GetMembers() []string {
+	members := Keys(ListItems("member"))
+
+	slices.Sort(members)
+
+	return members
+}
+
+// UpdateMembership publishes an add or remove event if pubkey's membership has changed since
+// it was last published, followed by a new membership list.
+func UpdateMembership(pubkey string) {
+	if updateMember(pubkey) {
+		PublishMembershipList()
+	}
+}
+
+// SyncMembership checks every known and published member
+func SyncMembership() {
+	pubkeys := Keys(ListItems("claim"))
+	pubkeys = append(pubkeys, Keys(ListItems("allowedpubkey"))...)
+	pubkeys = append(pubkeys, Keys(ListItems("member"))...)
+	pubkeys = append(pubkeys, RELAY_WHITELIST...)
+
+	list_whitelist_mu.RLock()
+	pubkeys = append(pubkeys, Keys(list_whitelist)...)
+	list_whitelist_mu.RUnlock()
+
+	slices.Sort(pubkeys)
+
+	changed := false
+	for _, pubkey := range slices.Compact(pubkeys) {
+		if updateMember(pubkey) {
+			changed = true
+		}
+	}
+
+	if changed {
+		PublishMembershipList()
+	}
+}
+
+func updateMember(pubkey string) bool {
+	membershipMu.Lock()
+	defer membershipMu.Unlock()
+
+	isMember := IsMember(pubkey)
+	wasMember := HasItem("member", pubkey)
+
+	if isMember == wasMember {
+		return false
+	}
+
+	kind := KindRemoveMember
+	if isMember {
+		kind = KindAddMember
+		PutItem("member", pubkey, []byte{})
+	} else {
+		DeleteItem("member", pubkey)
+	}
+
+	event := &nostr.Event{
+		Kind:      kind,
+		CreatedAt: nostr.Now(),
+		Tags: nostr.Tags{
+			nostr.Tag{"-"},
+			nostr.Tag{"p", pubkey},
+		},
+	}
+
+	if err := SignAsRelay(event); err != nil {
+		log.Println("Failed to sign membership event", err)
+	} else if err := GetBackend().SaveEvent(context.Background(), event); err != nil {
+		log.Println(err)
+	} else {
+		GetRelay().BroadcastEvent(event)
+	}
+
+	return true
+}
+
+func PublishMembershipList() {
+	event := &nostr.Event{
+		Kind:      KindMembershipList,
+		CreatedAt: nostr.Now(),
+		Tags: nostr.Tags{
+			nostr.Tag{"-"},
+		},
+	}
+
+	for _, pubkey := range GetMembers() {
+		event.Tags = append(event.Tags, nostr.Tag{"member", pubkey})
+	}
+
+	if err := SignAsRelay(event); err != nil {
+		log.Println("Failed to sign membership list", err)
+	} else if err := GetBackend().ReplaceEvent(context.Background(), event); err != nil {
+		log.Println(err)
+	} else {
+		GetRelay().BroadcastEvent(event)
+	}
+}
@@ -0,0 +1,32 @@
+package common
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestRevokedPubKeysAreNotMembers(t *testing.T) {
+	_, pubkey := testKeypair()
+
+	defer func(whitelist []string) { RELAY_WHITELIST = whitelist }(RELAY_WHITELIST)
+	RELAY_WHITELIST = append(slices.Clone(RELAY_WHITELIST), pubkey)
+
+	UpdateMembership(pubkey)
+
+	if !slices.Contains(GetMembers(), pubkey) {
+		t.Fatalf("expected whitelisted pubkeys to be members")
+	}
+
+	RevokeAccess(pubkey, "spam", REVOKE_INVITEES_NONE)
+
+	if IsMember(pubkey) || slices.Contains(GetMembers(), pubkey) {
+		t.Fatalf("expected revoked pubkeys to be removed from the membership list")
+	}
+
+	ReinstateAccess(pubkey)
+	UpdateMembership(pubkey)
+
+	if !slices.Contains(GetMembers(), pubkey) {
+		t.Fatalf("expected reinstated pubkeys to be members again")
+	}
+}
@@ -1,19 +1,718 @@
 package common
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"github.com/fiatjaf/khatru"
 	"github.com/nbd-wtf/go-nostr"
 	"github.com/nbd-wtf/go-nostr/nip86"
+	"io"
+	"mime"
+	"net"
+	"net/http"
 	"slices"
+	"strings"
+	"time"
 )
 
+// Extension methods not covered by nip86, dispatched through ManagementAPI.Generic
+
+type ManagementMethod func(ctx context.Context, params []any) (any, error)
+
+// managementMethods is a function rather than a variable, since the methods eventually refer
+// back to enableManaagementApi, which Go would consider an initialization cycle.
+func managementMethods() map[string]ManagementMethod {
+	return map[string]ManagementMethod{
+		"listinvitetree":          listInviteTree,
+		"revokepubkey":            revokePubKey,
+		"listflaggedpubkeys":      listFlaggedPubKeys,
+		"unflagpubkey":            unflagPubKey,
+		"listrevokedpubkeys":      listRevokedPubKeys,
+		"listinvites":             listInvites,
+		"rotateinvite":            rotateInvite,
+		"setinvitequota":          setInviteQuota,
+		"setclaiminvitequota":     setClaimInviteQuota,
+		"settierinvitequota":      setTierInviteQuota,
+		"listclaims":              listClaims,
+		"renewclaim":              renewClaim,
+		"disallowpubkey":          disallowPubKey,
+		"listdisallowedpubkeys":   listDisallowedPubKeys,
+		"unbanpubkey":             unbanPubKey,
+		"tempbanpubkey":           tempBanPubKey,
+		"purgepubkey":             purgePubKey,
+		"shadowbanpubkey":         shadowBanPubKey,
+		"unshadowbanpubkey":       unshadowBanPubKey,
+		"listshadowbannedpubkeys": listShadowBannedPubKeys,
+		"blockip":                 blockIP,
+		"unblockip":               unblockIP,
+		"listblockedips":          listBlockedIPs,
+		"listapplications":        listApplications,
+		"approveapplication":      approveApplication,
+		"denyapplication":         denyApplication,
+		"grantadmin":              grantAdmin,
+		"revokeadmin":             revokeAdmin,
+		"listmoderators":          listModerators,
+		"listauditlog":            listAuditLog,
+		"listreports":             listReports,
+		"resolvereport":           resolveReport,
+		"labelevent":              labelEvent,
+		"unlabelevent":            unlabelEvent,
+		"labelpubkey":             labelPubKey,
+		"unlabelpubkey":           unlabelPubKey,
+		"listlabels":              listLabels,
+		"setgrouplabelrules":      setGroupLabelRules,
+		"listgrouplabelrules":     listGroupLabelRules,
+	}
+}
+
+func getStringParam(params []any, i int) string {
+	if len(params) > i {
+		if s, ok := params[i].(string); ok {
+			return s
+		}
+	}
+
+	return ""
+}
+
+func getPubKeyParam(params []any, i int) (string, error) {
+	pubkey := getStringParam(params, i)
+
+	if !nostr.IsValidPublicKey(pubkey) {
+		return "", fmt.Errorf("invalid pubkey param")
+	}
+
+	return pubkey, nil
+}
+
+func getStringsParam(params []any, i int) ([]string, error) {
+	result := make([]string, 0)
+
+	if len(params) > i {
+		items, ok := params[i].([]any)
+		if !ok {
+			return nil, fmt.Errorf("invalid list param")
+		}
+
+		for _, item := range items {
+			s, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("invalid list param")
+			}
+
+			result = append(result, s)
+		}
+	}
+
+	return result, nil
+}
+
+func getIntParam(params []any, i int) (int, error) {
+	if len(params) > i {
+		if n, ok := params[i].(float64); ok && n == float64(int(n)) {
+			return int(n), nil
+		}
+	}
+
+	return 0, fmt.Errorf("invalid number param")
+}
+
+func disallowPubKey(ctx context.Context, params []any) (any, error) {
+	pubkey, err := getPubKeyParam(params, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkModerationTarget(ctx, pubkey); err != nil {
+		return nil, err
+	}
+
+	DeleteItem("allowedpubkey", pubkey)
+	PutItem("disallowedpubkey", pubkey, []byte(getStringParam(params, 1)))
+	UpdateMembership(pubkey)
+
+	return true, nil
+}
+
+func listDisallowedPubKeys(ctx context.Context, params []any) (any, error) {
+	items := ListItems("disallowedpubkey")
+	reasons := make([]nip86.PubKeyReason, 0, len(items))
+
+	for pubkey, reason := range items {
+		reasons = append(
+			reasons,
+			nip86.PubKeyReason{
+				PubKey: pubkey,
+				Reason: reason,
+			},
+		)
+	}
+
+	return reasons, nil
+}
+
+func unbanPubKey(ctx context.Context, params []any) (any, error) {
+	pubkey, err := getPubKeyParam(params, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	UnbanPubKey(pubkey)
+
+	return true, nil
+}
+
+func tempBanPubKey(ctx context.Context, params []any) (any, error) {
+	pubkey, err := getPubKeyParam(params, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkModerationTarget(ctx, pubkey); err != nil {
+		return nil, err
+	}
+
+	duration, err := ParseBanDuration(getStringParam(params, 1))
+	if err != nil || duration <= 0 {
+		return nil, fmt.Errorf("invalid duration param")
+	}
+
+	purge := getStringParam(params, 3)
+	if purge == "" {
+		purge = RELAY_PURGE_ON_BAN
+	}
+
+	if !slices.Contains(PURGE_MODES, purge) {
+		return nil, fmt.Errorf("invalid purge param, expected one of none, hide, or delete")
+	}
+
+	ban := BanPubKey(pubkey, getStringParam(params, 2), duration, purge)
+
+	if purge == PURGE_DELETE {
+		PurgePubKey(getManagementAuthed(ctx), pubkey)
+	}
+
+	return ban, nil
+}
+
+func shadowBanPubKey(ctx context.Context, params []any) (any, error) {
+	pubkey, err := getPubKeyParam(params, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkModerationTarget(ctx, pubkey); err != nil {
+		return nil, err
+	}
+
+	ShadowBanPubKey(pubkey, getStringParam(params, 1))
+
+	return true, nil
+}
+
+func unshadowBanPubKey(ctx context.Context, params []any) (any, error) {
+	pubkey, err := getPubKeyParam(params, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	UnshadowBanPubKey(pubkey)
+
+	return true, nil
+}
+
+func listShadowBannedPubKeys(ctx context.Context, params []any) (any, error) {
+	items := ListItems("shadowbannedpubkey")
+	reasons := make([]nip86.PubKeyReason, 0, len(items))
+
+	for pubkey, reason := range items {
+		reasons = append(
+			reasons,
+			nip86.PubKeyReason{
+				PubKey: pubkey,
+				Reason: reason,
+			},
+		)
+	}
+
+	return reasons, nil
+}
+
+// IP blocking is implemented as an extension, since go-nostr only accepts single addresses
+
+func blockIP(ctx context.Context, params []any) (any, error) {
+	ipnet, err := ParseIPRange(getStringParam(params, 0))
+	if err != nil {
+		return nil, err
+	}
+
+	BlockIP(ipnet, getStringParam(params, 1))
+
+	return true, nil
+}
+
+func unblockIP(ctx context.Context, params []any) (any, error) {
+	ipnet, err := ParseIPRange(getStringParam(params, 0))
+	if err != nil {
+		return nil, err
+	}
+
+	UnblockIP(ipnet)
+
+	return true, nil
+}
+
+func listBlockedIPs(ctx context.Context, params []any) (any, error) {
+	items := ListBlockedIPs()
+	reasons := make([]nip86.IPReason, 0, len(items))
+
+	for ip, reason := range items {
+		reasons = append(
+			reasons,
+			nip86.IPReason{
+				IP:     ip,
+				Reason: reason,
+			},
+		)
+	}
+
+	return reasons, nil
+}
+
+func purgePubKey(ctx context.Context, params []any) (any, error) {
+	pubkey, err := getPubKeyParam(params, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkModerationTarget(ctx, pubkey); err != nil {
+		return nil, err
+	}
+
+	PurgePubKey(getManagementAuthed(ctx), pubkey)
+
+	return true, nil
+}
+
+func listApplications(ctx context.Context, params []any) (any, error) {
+	status := getStringParam(params, 0)
+	if status == "" {
+		status = APPLICATION_PENDING
+	}
+
+	return ListApplications(status), nil
+}
+
+func approveApplication(ctx context.Context, params []any) (any, error) {
+	pubkey, err := getPubKeyParam(params, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if GetApplication(pubkey) == nil {
+		return nil, fmt.Errorf("no application found for this pubkey")
+	}
+
+	ApproveApplication(pubkey)
+
+	return true, nil
+}
+
+func denyApplication(ctx context.Context, params []any) (any, error) {
+	pubkey, err := getPubKeyParam(params, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if !DenyApplication(pubkey, getStringParam(params, 1)) {
+		return nil, fmt.Errorf("no application found for this pubkey")
+	}
+
+	return true, nil
+}
+
+func grantAdmin(ctx context.Context, params []any) (any, error) {
+	pubkey, err := getPubKeyParam(params, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	permissions, err := getStringsParam(params, 1)
+	if err != nil || len(permissions) == 0 {
+		return nil, fmt.Errorf("invalid permissions param")
+	}
+
+	if err := GrantModerator(pubkey, permissions); err != nil {
+		return nil, err
+	}
+
+	return true, nil
+}
+
+func revokeAdmin(ctx context.Context, params []any) (any, error) {
+	pubkey, err := getPubKeyParam(params, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	permissions, err := getStringsParam(params, 1)
+	if err != nil {
+		return nil, fmt.Errorf("invalid permissions param")
+	}
+
+	RevokeModerator(pubkey, permissions)
+
+	return true, nil
+}
+
+func listModerators(ctx context.Context, params []any) (any, error) {
+	return ListModerators(), nil
+}
+
+func listAuditLog(ctx context.Context, params []any) (any, error) {
+	var filter AuditFilter
+
+	if len(params) > 0 {
+		data, err := json.Marshal(params[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid filter param")
+		}
+
+		if err := json.Unmarshal(data, &filter); err != nil {
+			return nil, fmt.Errorf("invalid filter param")
+		}
+	}
+
+	// Older entries can be paged through using until
+	if filter.Limit <= 0 || filter.Limit > AUDIT_LOG_LIMIT {
+		filter.Limit = AUDIT_LOG_LIMIT
+	}
+
+	return QueryAuditLog(filter), nil
+}
+
+func listReports(ctx context.Context, params []any) (any, error) {
+	status := getStringParam(params, 0)
+	if status == "" {
+		status = REPORT_OPEN
+	}
+
+	return ListReportCases(status), nil
+}
+
+func resolveReport(ctx context.Context, params []any) (any, error) {
+	target := getStringParam(params, 0)
+	if !nostr.IsValid32ByteHex(target) {
+		return nil, fmt.Errorf("invalid target param")
+	}
+
+	notify := false
+	if len(params) > 3 {
+		if b, ok := params[3].(bool); ok {
+			notify = b
+		} else {
+			return nil, fmt.Errorf("invalid notify param")
+		}
+	}
+
+	return ResolveReport(ctx, getManagementAuthed(ctx), target, getStringParam(params, 1), getStringParam(params, 2), notify)
+}
+
+func getLabelsParam(params []any, i int) ([]string, error) {
+	labels, err := getStringsParam(params, i)
+	if err != nil {
+		return nil, fmt.Errorf("invalid labels param")
+	}
+
+	return ParseLabels(labels)
+}
+
+func labelEvent(ctx context.Context, params []any) (any, error) {
+	id := getStringParam(params, 0)
+	if !nostr.IsValid32ByteHex(id) {
+		return nil, fmt.Errorf("invalid id param")
+	}
+
+	labels, err := getLabelsParam(params, 1)
+	if err != nil || len(labels) == 0 {
+		return nil, fmt.Errorf("invalid labels param")
+	}
+
+	return AddLabels(id, LABEL_TARGET_EVENT, labels, getStringParam(params, 2)), nil
+}
+
+func unlabelEvent(ctx context.Context, params []any) (any, error) {
+	id := getStringParam(params, 0)
+	if !nostr.IsValid32ByteHex(id) {
+		return nil, fmt.Errorf("invalid id param")
+	}
+
+	labels, err := getLabelsParam(params, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	RemoveLabels(id, labels)
+
+	return true, nil
+}
+
+func labelPubKey(ctx context.Context, params []any) (any, error) {
+	pubkey, err := getPubKeyParam(params, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	labels, err := getLabelsParam(params, 1)
+	if err != nil || len(labels) == 0 {
+		return nil, fmt.Errorf("invalid labels param")
+	}
+
+	return AddLabels(pubkey, LABEL_TARGET_PUBKEY, labels, getStringParam(params, 2)), nil
+}
+
+func unlabelPubKey(ctx context.Context, params []any) (any, error) {
+	pubkey, err := getPubKeyParam(params, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	labels, err := getLabelsParam(params, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	RemoveLabels(pubkey, labels)
+
+	return true, nil
+}
+
+func listLabels(ctx context.Context, params []any) (any, error) {
+	return ListLabels(), nil
+}
+
+func setGroupLabelRules(ctx context.Context, params []any) (any, error) {
+	h := getStringParam(params, 0)
+	if GetGroup(h) == nil {
+		return nil, fmt.Errorf("unknown group")
+	}
+
+	labels, err := getLabelsParam(params, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	SetGroupLabelRules(h, labels)
+
+	return true, nil
+}
+
+func listGroupLabelRules(ctx context.Context, params []any) (any, error) {
+	return ListGroupLabelRules(), nil
+}
+
+func listInviteTree(ctx context.Context, params []any) (any, error) {
+	if root := getStringParam(params, 0); root != "" {
+		if !nostr.IsValidPublicKey(root) {
+			return nil, fmt.Errorf("invalid pubkey param")
+		}
+
+		return GetInviteTree(root), nil
+	}
+
+	return GetInviteForest(), nil
+}
+
+func listInvites(ctx context.Context, params []any) (any, error) {
+	pubkey, err := getPubKeyParam(params, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]any{
+		"invites": ListInvites(pubkey),
+		"quota":   GetInviteQuota(pubkey),
+	}, nil
+}
+
+func rotateInvite(ctx context.Context, params []any) (any, error) {
+	pubkey, err := getPubKeyParam(params, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return RotateInvite(pubkey), nil
+}
+
+func setInviteQuota(ctx context.Context, params []any) (any, error) {
+	pubkey, err := getPubKeyParam(params, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	quota, err := getIntParam(params, 1)
+	if err != nil || quota < 0 {
+		return nil, fmt.Errorf("invalid quota param")
+	}
+
+	SetInviteQuota(pubkey, quota)
+
+	return true, nil
+}
+
+func setClaimInviteQuota(ctx context.Context, params []any) (any, error) {
+	claim := getStringParam(params, 0)
+	if !IsValidClaim(claim) {
+		return nil, fmt.Errorf("invalid claim param")
+	}
+
+	quota, err := getIntParam(params, 1)
+	if err != nil || quota < 0 {
+		return nil, fmt.Errorf("invalid quota param")
+	}
+
+	SetClaimInviteQuota(claim, quota)
+
+	return true, nil
+}
+
+func setTierInviteQuota(ctx context.Context, params []any) (any, error) {
+	tier := getStringParam(params, 0)
+	if _, ok := RELAY_TIERS[tier]; !ok {
+		return nil, fmt.Errorf("invalid tier param")
+	}
+
+	quota, err := getIntParam(params, 1)
+	if err != nil || quota < 0 {
+		return nil, fmt.Errorf("invalid quota param")
+	}
+
+	SetTierInviteQuota(tier, quota)
+
+	return true, nil
+}
+
+func listClaims(ctx context.Context, params []any) (any, error) {
+	pubkey, err := getPubKeyParam(params, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return GetUserClaimRecords(pubkey), nil
+}
+
+func renewClaim(ctx context.Context, params []any) (any, error) {
+	pubkey, err := getPubKeyParam(params, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkModerationTarget(ctx, pubkey); err != nil {
+		return nil, err
+	}
+
+	claim := getStringParam(params, 1)
+	if claim == "" {
+		return nil, fmt.Errorf("invalid claim param")
+	}
+
+	defer UpdateMembership(pubkey)
+
+	if duration := getStringParam(params, 2); duration != "" {
+		period, err := time.ParseDuration(duration)
+		if err != nil || period < 0 {
+			return nil, fmt.Errorf("invalid duration param")
+		}
+
+		if period == 0 {
+			return GrantUserClaim(pubkey, claim, 0), nil
+		}
+
+		return ExtendUserClaim(pubkey, claim, period), nil
+	}
+
+	return GrantUserClaim(pubkey, claim, RELAY_CLAIM_TTL), nil
+}
+
+func revokePubKey(ctx context.Context, params []any) (any, error) {
+	pubkey, err := getPubKeyParam(params, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkModerationTarget(ctx, pubkey); err != nil {
+		return nil, err
+	}
+
+	cascade := getStringParam(params, 2)
+	if cascade == "" {
+		cascade = RELAY_REVOKE_INVITEES
+	}
+
+	if !slices.Contains([]string{REVOKE_INVITEES_NONE, REVOKE_INVITEES_REVOKE, REVOKE_INVITEES_FLAG}, cascade) {
+		return nil, fmt.Errorf("invalid cascade param, expected one of none, revoke, or flag")
+	}
+
+	RevokeAccess(pubkey, getStringParam(params, 1), cascade)
+
+	return true, nil
+}
+
+func listFlaggedPubKeys(ctx context.Context, params []any) (any, error) {
+	items := ListItems("flaggedpubkey")
+	reasons := make([]nip86.PubKeyReason, 0, len(items))
+
+	for pubkey, reason := range items {
+		reasons = append(
+			reasons,
+			nip86.PubKeyReason{
+				PubKey: pubkey,
+				Reason: reason,
+			},
+		)
+	}
+
+	return reasons, nil
+}
+
+func listRevokedPubKeys(ctx context.Context, params []any) (any, error) {
+	items := ListItems("revokedpubkey")
+	reasons := make([]nip86.PubKeyReason, 0, len(items))
+
+	for pubkey, reason := range items {
+		reasons = append(
+			reasons,
+			nip86.PubKeyReason{
+				PubKey: pubkey,
+				Reason: reason,
+			},
+		)
+	}
+
+	return reasons, nil
+}
+
+func unflagPubKey(ctx context.Context, params []any) (any, error) {
+	pubkey, err := getPubKeyParam(params, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	UnflagPubKey(pubkey)
+
+	return true, nil
+}
+
 func enableManaagementApi(relay *khatru.Relay) {
 	relay.RejectFilter = append(
 		relay.RejectFilter,
 		func(ctx context.Context, filter nostr.Filter) (reject bool, msg string) {
-			if HasItem("bannedpubkey", khatru.GetAuthed(ctx)) {
+			if IsBanned(khatru.GetAuthed(ctx)) {
 				return true, "restricted: you have been banned from this relay"
 			}
 
@@ -24,11 +723,11 @@ func enableManaagementApi(relay *khatru.Relay) {
 	relay.RejectEvent = append(
 		relay.RejectEvent,
 		func(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
-			if HasItem("bannedpubkey", khatru.GetAuthed(ctx)) {
+			if IsBanned(khatru.GetAuthed(ctx)) {
 				return true, "restricted: you have been banned from this relay"
 			}
 
-			if HasItem("bannedpubkey", event.PubKey) {
+			if IsBanned(event.PubKey) {
 				return true, "restricted: event author has been banned from this relay"
 			}
 
@@ -43,8 +742,8 @@ func enableManaagementApi(relay *khatru.Relay) {
 	relay.ManagementAPI.RejectAPICall = append(
 		relay.ManagementAPI.RejectAPICall,
 		func(ctx context.Context, mp nip86.MethodParams) (reject bool, msg string) {
-			if !slices.Contains(RELAY_ADMINS, khatru.GetAuthed(ctx)) {
-				return true, "blocked: only relay admins can manage this relay."
+			if !CanCallMethod(getManagementAuthed(ctx), mp.MethodName()) {
+				return true, "blocked: you are not allowed to call this method."
 			}
 
 			return false, ""
@@ -52,17 +751,38 @@ func enableManaagementApi(relay *khatru.Relay) {
 	)
 
 	relay.ManagementAPI.BanPubKey = func(ctx context.Context, pubkey string, reason string) error {
-		PutItem("bannedpubkey", pubkey, []byte(reason))
+		if err := checkModerationTarget(ctx, pubkey); err != nil {
+			return err
+		}
+
+		reason, duration, purge := ParseBanReason(reason)
+		if purge == "" {
+			purge = RELAY_PURGE_ON_BAN
+		}
+
+		ban := BanPubKey(pubkey, reason, duration, purge)
+		actor := getManagementAuthed(ctx)
+
+		AuditWithDetails(actor, "banpubkey", pubkey, reason, map[string]any{"expires": ban.Expires, "purge": ban.Purge})
+
+		if ban.Purge == PURGE_DELETE {
+			PurgePubKey(actor, pubkey)
+		}
+
 		return nil
 	}
 
 	relay.ManagementAPI.AllowPubKey = func(ctx context.Context, pubkey string, reason string) error {
-		DeleteItem("bannedpubkey", pubkey)
+		PutItem("allowedpubkey", pubkey, []byte(reason))
+		DeleteItem("disallowedpubkey", pubkey)
+		ReinstateAccess(pubkey)
+		UpdateMembership(pubkey)
+		Audit(getManagementAuthed(ctx), "allowpubkey", pubkey, reason)
 		return nil
 	}
 
-	relay.ManagementAPI.ListBannedPubKeys = func(ctx context.Context) ([]nip86.PubKeyReason, error) {
-		items := ListItems("bannedpubkey")
+	relay.ManagementAPI.ListAllowedPubKeys = func(ctx context.Context) ([]nip86.PubKeyReason, error) {
+		items := ListItems("allowedpubkey")
 		reasons := make([]nip86.PubKeyReason, 0, len(items))
 
 		for pubkey, reason := range items {
@@ -78,6 +798,23 @@ func enableManaagementApi(relay *khatru.Relay) {
 		return reasons, nil
 	}
 
+	relay.ManagementAPI.ListBannedPubKeys = func(ctx context.Context) ([]nip86.PubKeyReason, error) {
+		bans := ListBans()
+		reasons := make([]nip86.PubKeyReason, 0, len(bans))
+
+		for pubkey, ban := range bans {
+			reasons = append(
+				reasons,
+				nip86.PubKeyReason{
+					PubKey: pubkey,
+					Reason: ban.Describe(),
+				},
+			)
+		}
+
+		return reasons, nil
+	}
+
 	relay.ManagementAPI.BanEvent = func(ctx context.Context, id string, reason string) error {
 		filter := nostr.Filter{
 			IDs: []string{id},
@@ -93,12 +830,14 @@ func enableManaagementApi(relay *khatru.Relay) {
 		}
 
 		PutItem("bannedevent", id, []byte(reason))
+		Audit(getManagementAuthed(ctx), "banevent", id, reason)
 
 		return nil
 	}
 
 	relay.ManagementAPI.AllowEvent = func(ctx context.Context, id string, reason string) error {
 		DeleteItem("bannedevent", id)
+		Audit(getManagementAuthed(ctx), "allowevent", id, reason)
 		return nil
 	}
 
@@ -118,4 +857,208 @@ func enableManaagementApi(relay *khatru.Relay) {
 
 		return reasons, nil
 	}
+
+	relay.ManagementAPI.ChangeRelayName = func(ctx context.Context, name string) error {
+		if err := SetRelayInfo(RELAY_INFO_NAME, name); err != nil {
+			return err
+		}
+
+		Audit(getManagementAuthed(ctx), "changerelayname", "", name)
+
+		return nil
+	}
+
+	relay.ManagementAPI.ChangeRelayDescription = func(ctx context.Context, description string) error {
+		if err := SetRelayInfo(RELAY_INFO_DESCRIPTION, description); err != nil {
+			return err
+		}
+
+		Audit(getManagementAuthed(ctx), "changerelaydescription", "", description)
+
+		return nil
+	}
+
+	relay.ManagementAPI.ChangeRelayIcon = func(ctx context.Context, icon string) error {
+		if err := SetRelayInfo(RELAY_INFO_ICON, icon); err != nil {
+			return err
+		}
+
+		Audit(getManagementAuthed(ctx), "changerelayicon", "", icon)
+
+		return nil
+	}
+
+	relay.ManagementAPI.Generic = func(ctx context.Context, req nip86.Request) (nip86.Response, error) {
+		method, ok := managementMethods()[req.Method]
+		if !ok {
+			return nip86.Response{}, fmt.Errorf("method '%s' not known", req.Method)
+		}
+
+		result, err := method(ctx, req.Params)
+		if err != nil {
+			return nip86.Response{}, err
+		}
+
+		return nip86.Response{Result: result}, nil
+	}
+}
+
+// go-nostr refuses to decode methods it doesn't know about, and panics on grantadmin and
+// revokeadmin params that came from JSON, so khatru never gets as far as ManagementAPI.Generic
+// for our extension methods. Intercept those requests and authenticate them the same way.
+
+type managementAuthKey struct{}
+
+type extensionMethod string
+
+func (m extensionMethod) MethodName() string { return string(m) }
+
+func getManagementAuthed(ctx context.Context) string {
+	if pubkey, ok := ctx.Value(managementAuthKey{}).(string); ok {
+		return pubkey
+	}
+
+	return khatru.GetAuthed(ctx)
+}
+
+func WithManagementExtensions(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); r.Method != http.MethodPost || mediaType != "application/nostr+json+rpc" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// khatru checks standard methods itself, so give it a content type it recognizes, and
+		// don't let it believe forwarded headers that didn't come from a trusted proxy
+		r.Header.Set("Content-Type", "application/nostr+json+rpc")
+
+		if ip := getRemoteIP(r); ip == nil || !isTrustedProxy(ip) {
+			r.Header.Del("X-Forwarded-Host")
+			r.Header.Del("X-Forwarded-Proto")
+		}
+
+		payload, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "failed to read body", http.StatusBadRequest)
+			return
+		}
+
+		var req nip86.Request
+		if err := json.Unmarshal(payload, &req); err != nil {
+			r.Body = io.NopCloser(bytes.NewReader(payload))
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if _, ok := managementMethods()[req.Method]; !ok {
+			r.Body = io.NopCloser(bytes.NewReader(payload))
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/nostr+json+rpc")
+
+		var resp nip86.Response
+
+		if pubkey, err := checkManagementAuth(r, payload); err != nil {
+			resp.Error = err.Error()
+		} else {
+			ctx := context.WithValue(r.Context(), managementAuthKey{}, pubkey)
+			resp = callManagementMethod(ctx, req)
+		}
+
+		json.NewEncoder(w).Encode(resp)
+	})
+}
+
+func checkManagementAuth(r *http.Request, payload []byte) (string, error) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Nostr ")
+	if !ok {
+		return "", fmt.Errorf("missing auth")
+	}
+
+	data, err := base64.StdEncoding.DecodeString(token)
+	if err != nil {
+		return "", fmt.Errorf("invalid base64 auth")
+	}
+
+	var event nostr.Event
+	if err := json.Unmarshal(data, &event); err != nil {
+		return "", fmt.Errorf("invalid auth event json")
+	}
+
+	if ok, _ := event.CheckSignature(); !ok || event.Kind != nostr.KindHTTPAuth {
+		return "", fmt.Errorf("invalid auth event")
+	}
+
+	if uTag := event.Tags.GetFirst([]string{"u", ""}); uTag == nil || nostr.NormalizeURL(uTag.Value()) != nostr.NormalizeURL(getRequestBaseURL(r)) {
+		return "", fmt.Errorf("invalid 'u' tag")
+	}
+
+	if methodTag := event.Tags.GetFirst([]string{"method", ""}); methodTag == nil || methodTag.Value() != r.Method {
+		return "", fmt.Errorf("invalid 'method' tag")
+	}
+
+	hash := sha256.Sum256(payload)
+	if event.Tags.FindWithValue("payload", hex.EncodeToString(hash[:])) == nil {
+		return "", fmt.Errorf("invalid auth event payload hash")
+	}
+
+	if event.CreatedAt < nostr.Now()-30 {
+		return "", fmt.Errorf("auth event is too old")
+	}
+
+	if event.CreatedAt > nostr.Now() {
+		return "", fmt.Errorf("auth event is from the future")
+	}
+
+	return event.PubKey, nil
+}
+
+// getRequestBaseURL works out the url a request was sent to, the same way khatru does for its own
+// management requests, except that forwarded headers are only believed from RELAY_TRUSTED_PROXIES.
+func getRequestBaseURL(r *http.Request) string {
+	host := r.Host
+	proto := ""
+
+	if ip := getRemoteIP(r); ip != nil && isTrustedProxy(ip) {
+		if forwarded := r.Header.Get("X-Forwarded-Host"); forwarded != "" {
+			host = forwarded
+		}
+
+		proto = r.Header.Get("X-Forwarded-Proto")
+	}
+
+	if proto == "" {
+		// Hosts with a port, local hosts, and bare IPs are assumed not to be using TLS
+		if _, _, err := net.SplitHostPort(host); err == nil || host == "localhost" || net.ParseIP(host) != nil {
+			proto = "http"
+		} else {
+			proto = "https"
+		}
+	}
+
+	return proto + "://" + host
+}
+
+func callManagementMethod(ctx context.Context, req nip86.Request) nip86.Response {
+	relay := GetRelay()
+
+	for _, reject := range relay.ManagementAPI.RejectAPICall {
+		if rejected, msg := reject(ctx, extensionMethod(req.Method)); rejected {
+			return nip86.Response{Error: msg}
+		}
+	}
+
+	resp, err := relay.ManagementAPI.Generic(ctx, req)
+	if err != nil {
+		return nip86.Response{Error: err.Error()}
+	}
+
+	// Record everything except for read-only methods
+	if !strings.HasPrefix(req.Method, "list") {
+		AuditWithDetails(getManagementAuthed(ctx), req.Method, getStringParam(req.Params, 0), "", req.Params)
+	}
+
+	return resp
 }
@@ -0,0 +1,226 @@
+package common
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip86"
+)
+
+type managementClient struct {
+	t      *testing.T
+	server *httptest.Server
+
+	// tamper, if set, changes auth events before they're signed
+	tamper func(auth *nostr.Event)
+}
+
+func newManagementClient(t *testing.T) *managementClient {
+	server := httptest.NewServer(WithManagementExtensions(GetRelay()))
+	t.Cleanup(server.Close)
+
+	return &managementClient{t: t, server: server}
+}
+
+// call sends a NIP 86 request signed by secret, with a NIP 98 event for u
+func (c *managementClient) call(secret string, u string, headers map[string]string, method string, params ...any) nip86.Response {
+	payload, _ := json.Marshal(nip86.Request{Method: method, Params: params})
+	hash := sha256.Sum256(payload)
+
+	auth := nostr.Event{
+		Kind:      nostr.KindHTTPAuth,
+		CreatedAt: nostr.Now(),
+		Tags: nostr.Tags{
+			{"u", u},
+			{"method", "POST"},
+			{"payload", hex.EncodeToString(hash[:])},
+		},
+	}
+	if c.tamper != nil {
+		c.tamper(&auth)
+	}
+
+	auth.Sign(secret)
+
+	data, _ := json.Marshal(auth)
+
+	req, _ := http.NewRequest("POST", c.server.URL, bytes.NewReader(payload))
+	req.Header.Set("Content-Type", "application/nostr+json+rpc; charset=utf-8")
+	req.Header.Set("Authorization", "Nostr "+base64.StdEncoding.EncodeToString(data))
+
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	var resp nip86.Response
+	if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+		c.t.Fatalf("%s returned an invalid response: %v", method, err)
+	}
+
+	return resp
+}
+
+func TestManagementExtensionRouting(t *testing.T) {
+	client := newManagementClient(t)
+	_, target := testKeypair()
+
+	BanPubKey(target, "spam", 0, PURGE_NONE)
+
+	if resp := client.call(testAdminSecret, client.server.URL, nil, "unbanpubkey", target); resp.Error != "" {
+		t.Fatalf("unbanpubkey failed: %s", resp.Error)
+	}
+
+	if IsBanned(target) {
+		t.Fatalf("unbanpubkey didn't lift the ban")
+	}
+
+	if resp := client.call(testAdminSecret, client.server.URL, nil, "listmoderators"); resp.Error != "" {
+		t.Fatalf("listmoderators failed: %s", resp.Error)
+	}
+
+	// Standard methods are still handled by khatru
+	if resp := client.call(testAdminSecret, client.server.URL, nil, "banpubkey", target, "spam"); resp.Error != "" {
+		t.Fatalf("banpubkey failed: %s", resp.Error)
+	}
+
+	if !IsBanned(target) {
+		t.Fatalf("banpubkey didn't ban")
+	}
+
+	UnbanPubKey(target)
+}
+
+func TestManagementExtensionAuth(t *testing.T) {
+	client := newManagementClient(t)
+	secret, pubkey := testKeypair()
+
+	if resp := client.call(secret, client.server.URL, nil, "listmoderators"); !strings.HasPrefix(resp.Error, "blocked") {
+		t.Fatalf("expected non-admins to be blocked, got %+v", resp)
+	}
+
+	if resp := client.call(testAdminSecret, "http://example.com", nil, "listmoderators"); resp.Error != "invalid 'u' tag" {
+		t.Fatalf("expected a mismatched url to be refused, got %+v", resp)
+	}
+
+	// Requests that don't come from a trusted proxy can't pick the url they're checked against
+	forwarded := map[string]string{"X-Forwarded-Host": "example.com", "X-Forwarded-Proto": "https"}
+	if resp := client.call(testAdminSecret, "https://example.com", forwarded, "listmoderators"); resp.Error != "invalid 'u' tag" {
+		t.Fatalf("expected forwarded headers from an untrusted peer to be ignored, got %+v", resp)
+	}
+
+	defer func(proxies []*net.IPNet) { RELAY_TRUSTED_PROXIES = proxies }(RELAY_TRUSTED_PROXIES)
+	RELAY_TRUSTED_PROXIES = parseIPRanges("127.0.0.1")
+
+	if resp := client.call(testAdminSecret, "https://example.com", forwarded, "listmoderators"); resp.Error != "" {
+		t.Fatalf("expected forwarded headers from a trusted proxy to be used, got %+v", resp)
+	}
+
+	// Moderators can only act against regular users
+	GrantModerator(pubkey, []string{"banpubkey"})
+	defer RevokeModerator(pubkey, nil)
+
+	_, other := testKeypair()
+
+	if resp := client.call(secret, client.server.URL, nil, "tempbanpubkey", other, "1d"); resp.Error != "" {
+		t.Fatalf("expected moderator to be able to ban, got %+v", resp)
+	}
+
+	UnbanPubKey(other)
+
+	_, moderator := testKeypair()
+	GrantModerator(moderator, []string{"banevent"})
+	defer RevokeModerator(moderator, nil)
+
+	for _, target := range []string{testAdmin, moderator} {
+		if resp := client.call(secret, client.server.URL, nil, "tempbanpubkey", target, "1d"); resp.Error == "" {
+			t.Fatalf("expected moderator to be refused banning %s", target)
+		}
+
+		if resp := client.call(secret, client.server.URL, nil, "banpubkey", target, "spam"); resp.Error == "" {
+			t.Fatalf("expected moderator to be refused banning %s", target)
+		}
+
+		if IsBanned(target) {
+			t.Fatalf("moderator was able to ban %s", target)
+		}
+	}
+}
+
+func TestManagementAuthEventChecks(t *testing.T) {
+	client := newManagementClient(t)
+
+	client.tamper = func(auth *nostr.Event) {
+		auth.Tags = slices.DeleteFunc(auth.Tags, func(tag nostr.Tag) bool { return tag.Key() == "method" })
+		auth.Tags = append(auth.Tags, nostr.Tag{"method", "GET"})
+	}
+
+	if resp := client.call(testAdminSecret, client.server.URL, nil, "listmoderators"); resp.Error != "invalid 'method' tag" {
+		t.Fatalf("expected an auth event for another method to be refused, got %+v", resp)
+	}
+
+	client.tamper = func(auth *nostr.Event) {
+		auth.Tags = slices.DeleteFunc(auth.Tags, func(tag nostr.Tag) bool { return tag.Key() == "method" })
+	}
+
+	if resp := client.call(testAdminSecret, client.server.URL, nil, "listmoderators"); resp.Error != "invalid 'method' tag" {
+		t.Fatalf("expected an auth event without a method to be refused, got %+v", resp)
+	}
+
+	client.tamper = func(auth *nostr.Event) {
+		auth.CreatedAt = nostr.Now() + 3600
+	}
+
+	if resp := client.call(testAdminSecret, client.server.URL, nil, "listmoderators"); resp.Error != "auth event is from the future" {
+		t.Fatalf("expected an auth event from the future to be refused, got %+v", resp)
+	}
+
+	client.tamper = nil
+
+	if resp := client.call(testAdminSecret, client.server.URL, nil, "listmoderators"); resp.Error != "" {
+		t.Fatalf("expected a valid auth event to be accepted, got %+v", resp)
+	}
+}
+
+func TestModeratorsCannotChangeAdminsAccess(t *testing.T) {
+	client := newManagementClient(t)
+	secret, pubkey := testKeypair()
+
+	GrantModerator(pubkey, []string{"members"})
+	defer RevokeModerator(pubkey, nil)
+
+	_, member := testKeypair()
+
+	if resp := client.call(secret, client.server.URL, nil, "renewclaim", member, "claim", "1h"); resp.Error != "" {
+		t.Fatalf("expected moderator to be able to renew a member's claim, got %+v", resp)
+	}
+
+	if resp := client.call(secret, client.server.URL, nil, "disallowpubkey", member); resp.Error != "" {
+		t.Fatalf("expected moderator to be able to disallow a member, got %+v", resp)
+	}
+
+	for _, method := range []string{"renewclaim", "disallowpubkey"} {
+		if resp := client.call(secret, client.server.URL, nil, method, testAdmin, "claim", "1h"); !strings.HasPrefix(resp.Error, "blocked") {
+			t.Fatalf("expected moderator to be refused calling %s on an admin, got %+v", method, resp)
+		}
+	}
+
+	if HasItem("disallowedpubkey", testAdmin) || len(GetUserClaims(testAdmin)) > 0 {
+		t.Fatalf("moderator was able to change an admin's access")
+	}
+}
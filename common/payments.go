@@ -0,0 +1,350 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip11"
+)
+
+// Paid relay membership. Payment providers create invoices and report their status, and a
+// paid invoice grants PAID_CLAIM for RELAY_MEMBERSHIP_PERIOD.
+
+const PAID_CLAIM = "paid"
+
+const (
+	INVOICE_PENDING = "pending"
+	INVOICE_PAID    = "paid"
+	INVOICE_EXPIRED = "expired"
+)
+
+type Invoice struct {
+	ID        string          `json:"id"`
+	PubKey    string          `json:"pubkey"`
+	Amount    int             `json:"amount"`
+	Unit      string          `json:"unit"`
+	Request   string          `json:"request"`
+	Status    string          `json:"status"`
+	CreatedAt nostr.Timestamp `json:"created_at"`
+}
+
+type PaymentProvider interface {
+	// CreateInvoice asks the provider for a new invoice, including the request (a bolt11
+	// string, a checkout url, etc.) that the user needs in order to pay it.
+	CreateInvoice(ctx context.Context, pubkey string, amount int, unit string) (Invoice, error)
+
+	// CheckStatus returns the current status of an invoice created by this provider.
+	CheckStatus(ctx context.Context, invoice Invoice) (string, error)
+
+	// HandleWebhook verifies a callback from the provider and returns the id of the invoice
+	// it concerns.
+	HandleWebhook(r *http.Request) (string, error)
+}
+
+var paymentProviders = map[string]func() PaymentProvider{
+	"mock": func() PaymentProvider {
+		// Anyone can mark a mock invoice as paid, so it has to be asked for explicitly
+		if !RELAY_ENABLE_MOCK_PAYMENTS {
+			log.Println("The mock payment provider requires RELAY_ENABLE_MOCK_PAYMENTS=true")
+			return nil
+		}
+
+		return NewMockPaymentProvider()
+	},
+}
+
+var (
+	paymentProvider     PaymentProvider
+	paymentProviderOnce sync.Once
+	invoice_lock        sync.Mutex
+)
+
+func GetPaymentProvider() PaymentProvider {
+	paymentProviderOnce.Do(func() {
+		if makeProvider, ok := paymentProviders[RELAY_PAYMENT_PROVIDER]; ok {
+			paymentProvider = makeProvider()
+		} else if RELAY_PAYMENT_PROVIDER != "" {
+			log.Printf("Unknown payment provider %s", RELAY_PAYMENT_PROVIDER)
+		}
+	})
+
+	return paymentProvider
+}
+
+func GetInvoice(id string) *Invoice {
+	var invoice Invoice
+
+	if err := json.Unmarshal(GetItem("invoice", id), &invoice); err != nil {
+		return nil
+	}
+
+	return &invoice
+}
+
+func PutInvoice(invoice Invoice) {
+	data, err := json.Marshal(invoice)
+	if err != nil {
+		log.Println(err)
+	} else {
+		PutItem("invoice", invoice.ID, data)
+	}
+}
+
+func CreateInvoice(ctx context.Context, pubkey string) (Invoice, error) {
+	invoice, err := GetPaymentProvider().CreateInvoice(ctx, pubkey, RELAY_MEMBERSHIP_FEE, RELAY_MEMBERSHIP_FEE_UNIT)
+	if err != nil {
+		return invoice, err
+	}
+
+	invoice.PubKey = pubkey
+	invoice.Status = INVOICE_PENDING
+	invoice.CreatedAt = nostr.Now()
+
+	PutInvoice(invoice)
+
+	return invoice, nil
+}
+
+// RefreshInvoice asks the provider about a pending invoice, and grants membership if it
+// has been paid. Invoices are only ever honored once.
+func RefreshInvoice(ctx context.Context, id string) (*Invoice, error) {
+	invoice := GetInvoice(id)
+	if invoice == nil {
+		return nil, fmt.Errorf("unknown invoice")
+	}
+
+	if invoice.Status != INVOICE_PENDING {
+		return invoice, nil
+	}
+
+	status, err := GetPaymentProvider().CheckStatus(ctx, *invoice)
+	if err != nil {
+		return invoice, err
+	}
+
+	if status == INVOICE_PENDING {
+		return invoice, nil
+	}
+
+	invoice_lock.Lock()
+	defer invoice_lock.Unlock()
+
+	// Only the first request to see the invoice settle gets to act on it
+	if latest := GetInvoice(id); latest == nil || latest.Status != INVOICE_PENDING {
+		return latest, nil
+	}
+
+	invoice.Status = status
+	PutInvoice(*invoice)
+
+	if status == INVOICE_PAID {
+		expires := ExtendUserClaim(invoice.PubKey, PAID_CLAIM, RELAY_MEMBERSHIP_PERIOD)
+		UpdateMembership(invoice.PubKey)
+		AuditWithDetails(RELAY_SELF, "grantclaim", invoice.PubKey, "payment received", map[string]any{
+			"claim":   PAID_CLAIM,
+			"invoice": invoice.ID,
+			"expires": expires,
+		})
+
+		if expires == 0 {
+			log.Printf("Invoice %s paid, %s is a member", invoice.ID, invoice.PubKey)
+		} else {
+			log.Printf("Invoice %s paid, %s is a member until %s", invoice.ID, invoice.PubKey, expires.Time())
+		}
+	}
+
+	return invoice, nil
+}
+
+// PruneExpiredInvoices discards invoices that went unpaid for RELAY_INVOICE_TTL. Pending
+// invoices are checked one last time first, in case a payment was missed. The number of
+// invoices discarded is returned.
+func PruneExpiredInvoices(ctx context.Context) int {
+	cutoff := nostr.Timestamp(time.Now().Add(-RELAY_INVOICE_TTL).Unix())
+	pruned := 0
+
+	for id := range ListItems("invoice") {
+		invoice := GetInvoice(id)
+		if invoice == nil || invoice.Status == INVOICE_PAID || invoice.CreatedAt > cutoff {
+			continue
+		}
+
+		if invoice.Status == INVOICE_PENDING && GetPaymentProvider() != nil {
+			if refreshed, err := RefreshInvoice(ctx, id); err != nil {
+				log.Println(err)
+				continue
+			} else if refreshed != nil && refreshed.Status == INVOICE_PAID {
+				continue
+			}
+		}
+
+		DeleteItem("invoice", id)
+		pruned++
+	}
+
+	return pruned
+}
+
+// GetRelayFees describes the membership fee for NIP 11
+func GetRelayFees() *nip11.RelayFeesDocument {
+	fees := &nip11.RelayFeesDocument{}
+
+	if RELAY_MEMBERSHIP_PERIOD > 0 {
+		fees.Subscription = append(fees.Subscription, struct {
+			Amount int    `json:"amount"`
+			Unit   string `json:"unit"`
+			Period int    `json:"period"`
+		}{RELAY_MEMBERSHIP_FEE, RELAY_MEMBERSHIP_FEE_UNIT, int(RELAY_MEMBERSHIP_PERIOD.Seconds())})
+	} else {
+		fees.Admission = append(fees.Admission, struct {
+			Amount int    `json:"amount"`
+			Unit   string `json:"unit"`
+		}{RELAY_MEMBERSHIP_FEE, RELAY_MEMBERSHIP_FEE_UNIT})
+	}
+
+	return fees
+}
+
+func enablePayments(relay *khatru.Relay) {
+	if GetPaymentProvider() == nil {
+		return
+	}
+
+	relay.Info.Fees = GetRelayFees()
+	relay.Info.PaymentsURL = fmt.Sprintf("https://%s/invoice", RELAY_URL)
+
+	mux := relay.Router()
+
+	mux.HandleFunc("GET /invoice", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]any{
+			"fees":     relay.Info.Fees,
+			"provider": RELAY_PAYMENT_PROVIDER,
+			"create":   "POST a JSON body like {\"pubkey\": \"<pubkey>\"} to this url to create an invoice",
+		})
+	})
+
+	mux.HandleFunc("POST /invoice", func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			PubKey string `json:"pubkey"`
+		}
+
+		if !AllowIPRequest("invoice", r, RELAY_INVOICE_RATE_LIMIT, time.Hour) {
+			http.Error(w, "too many invoices, try again later", http.StatusTooManyRequests)
+			return
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || !nostr.IsValidPublicKey(body.PubKey) {
+			http.Error(w, "invalid pubkey", http.StatusBadRequest)
+			return
+		}
+
+		invoice, err := CreateInvoice(r.Context(), body.PubKey)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, "failed to create invoice", http.StatusBadGateway)
+			return
+		}
+
+		writeJSON(w, invoice)
+	})
+
+	mux.HandleFunc("GET /invoice/{id}", func(w http.ResponseWriter, r *http.Request) {
+		invoice, err := RefreshInvoice(r.Context(), r.PathValue("id"))
+		if invoice == nil {
+			http.Error(w, "unknown invoice", http.StatusNotFound)
+			return
+		}
+
+		if err != nil {
+			log.Println(err)
+		}
+
+		writeJSON(w, invoice)
+	})
+
+	mux.HandleFunc("POST /invoice/webhook", func(w http.ResponseWriter, r *http.Request) {
+		id, err := GetPaymentProvider().HandleWebhook(r)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, "invalid webhook", http.StatusBadRequest)
+			return
+		}
+
+		if _, err := RefreshInvoice(r.Context(), id); err != nil {
+			log.Println(err)
+			http.Error(w, "failed to check invoice", http.StatusBadGateway)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, value any) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Println(err)
+	}
+}
+
+// MockPaymentProvider keeps invoices in memory and considers them paid once MarkPaid is
+// called, or a webhook is received with their id. It's meant for development and tests.
+type MockPaymentProvider struct {
+	mu   sync.Mutex
+	paid map[string]bool
+}
+
+func NewMockPaymentProvider() *MockPaymentProvider {
+	return &MockPaymentProvider{paid: make(map[string]bool)}
+}
+
+func (p *MockPaymentProvider) CreateInvoice(ctx context.Context, pubkey string, amount int, unit string) (Invoice, error) {
+	id := RandomString(16)
+
+	return Invoice{
+		ID:      id,
+		Amount:  amount,
+		Unit:    unit,
+		Request: "mock:" + id,
+	}, nil
+}
+
+func (p *MockPaymentProvider) CheckStatus(ctx context.Context, invoice Invoice) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.paid[invoice.ID] {
+		return INVOICE_PAID, nil
+	}
+
+	return INVOICE_PENDING, nil
+}
+
+func (p *MockPaymentProvider) HandleWebhook(r *http.Request) (string, error) {
+	var body struct {
+		ID string `json:"id"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return "", err
+	}
+
+	p.MarkPaid(body.ID)
+
+	return body.ID, nil
+}
+
+func (p *MockPaymentProvider) MarkPaid(id string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.paid[id] = true
+}
@@ -0,0 +1,236 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func useMockPaymentProvider() *MockPaymentProvider {
+	provider := NewMockPaymentProvider()
+
+	paymentProviderOnce.Do(func() {})
+	paymentProvider = provider
+
+	return provider
+}
+
+func TestPaymentFlow(t *testing.T) {
+	useMockPaymentProvider()
+
+	relay := khatru.NewRelay()
+	enablePayments(relay)
+
+	server := httptest.NewServer(relay)
+	defer server.Close()
+
+	_, pubkey := testKeypair()
+
+	body, _ := json.Marshal(map[string]string{"pubkey": pubkey})
+	res, err := http.Post(server.URL+"/invoice", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var invoice Invoice
+	if err := json.NewDecoder(res.Body).Decode(&invoice); err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if invoice.Status != INVOICE_PENDING || invoice.PubKey != pubkey {
+		t.Fatalf("unexpected invoice %+v", invoice)
+	}
+
+	if slices.Contains(GetUserClaims(pubkey), PAID_CLAIM) {
+		t.Fatalf("claim granted before payment")
+	}
+
+	body, _ = json.Marshal(map[string]string{"id": invoice.ID})
+	res, err = http.Post(server.URL+"/invoice/webhook", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("webhook responded with %d", res.StatusCode)
+	}
+
+	if GetInvoice(invoice.ID).Status != INVOICE_PAID {
+		t.Fatalf("invoice not marked as paid")
+	}
+
+	if !slices.Contains(GetUserClaims(pubkey), PAID_CLAIM) {
+		t.Fatalf("claim not granted after payment")
+	}
+
+	res, err = http.Get(server.URL + "/invoice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("payments url responded with %d", res.StatusCode)
+	}
+}
+
+// slowPaymentProvider widens the window between checking an invoice and acting on it
+type slowPaymentProvider struct {
+	*MockPaymentProvider
+}
+
+func (p slowPaymentProvider) CheckStatus(ctx context.Context, invoice Invoice) (string, error) {
+	time.Sleep(10 * time.Millisecond)
+
+	return p.MockPaymentProvider.CheckStatus(ctx, invoice)
+}
+
+func TestRefreshInvoiceIsIdempotent(t *testing.T) {
+	provider := useMockPaymentProvider()
+	paymentProvider = slowPaymentProvider{provider}
+
+	_, pubkey := testKeypair()
+	ctx := context.Background()
+
+	invoice, err := CreateInvoice(ctx, pubkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	provider.MarkPaid(invoice.ID)
+
+	var wg sync.WaitGroup
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			RefreshInvoice(ctx, invoice.ID)
+		}()
+	}
+	wg.Wait()
+
+	RefreshInvoice(ctx, invoice.ID)
+
+	records := GetUserClaimRecords(pubkey)
+	if len(records) != 1 {
+		t.Fatalf("expected a single claim, got %+v", records)
+	}
+
+	if grants := QueryAuditLog(AuditFilter{Action: "grantclaim", Target: pubkey}); len(grants) != 1 {
+		t.Fatalf("invoice was honored %d times", len(grants))
+	}
+
+	limit := nostr.Now() + nostr.Timestamp(RELAY_MEMBERSHIP_PERIOD.Seconds()) + 5
+	if records[0].Expires > limit {
+		t.Fatalf("invoice was honored more than once, claim expires at %s", records[0].Expires.Time())
+	}
+}
+
+func TestPermanentMembership(t *testing.T) {
+	_, pubkey := testKeypair()
+
+	if expires := ExtendUserClaim(pubkey, PAID_CLAIM, 0); expires != 0 {
+		t.Fatalf("expected a permanent claim, got expiry %d", expires)
+	}
+
+	if expires := ExtendUserClaim(pubkey, PAID_CLAIM, time.Hour); expires != 0 {
+		t.Fatalf("extending a permanent claim should keep it permanent, got expiry %d", expires)
+	}
+
+	if !slices.Contains(GetUserClaims(pubkey), PAID_CLAIM) {
+		t.Fatalf("permanent claim not granted")
+	}
+}
+
+func TestInvoiceRateLimit(t *testing.T) {
+	useMockPaymentProvider()
+
+	defer func(limit int) { RELAY_INVOICE_RATE_LIMIT = limit }(RELAY_INVOICE_RATE_LIMIT)
+	RELAY_INVOICE_RATE_LIMIT = 2
+
+	ip_ratesLock.Lock()
+	clear(ip_rates)
+	ip_ratesLock.Unlock()
+
+	relay := khatru.NewRelay()
+	enablePayments(relay)
+
+	server := httptest.NewServer(relay)
+	defer server.Close()
+
+	_, pubkey := testKeypair()
+	body, _ := json.Marshal(map[string]string{"pubkey": pubkey})
+
+	for i := range 3 {
+		res, err := http.Post(server.URL+"/invoice", "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		expected := http.StatusOK
+		if i == 2 {
+			expected = http.StatusTooManyRequests
+		}
+
+		if res.StatusCode != expected {
+			t.Fatalf("expected request %d to get %d, got %d", i+1, expected, res.StatusCode)
+		}
+	}
+}
+
+func TestPruneExpiredInvoices(t *testing.T) {
+	provider := useMockPaymentProvider()
+	ctx := context.Background()
+	stale := nostr.Timestamp(time.Now().Add(-RELAY_INVOICE_TTL).Unix()) - 1
+
+	_, pubkey := testKeypair()
+
+	create := func(createdAt nostr.Timestamp) Invoice {
+		invoice, err := CreateInvoice(ctx, pubkey)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		invoice.CreatedAt = createdAt
+		PutInvoice(invoice)
+
+		return invoice
+	}
+
+	unpaid := create(stale)
+	missed := create(stale)
+	recent := create(nostr.Now())
+
+	// A payment whose webhook never arrived is honored rather than discarded
+	provider.MarkPaid(missed.ID)
+
+	PruneExpiredInvoices(ctx)
+
+	if GetInvoice(unpaid.ID) != nil {
+		t.Fatalf("expected stale unpaid invoices to be discarded")
+	}
+
+	if invoice := GetInvoice(missed.ID); invoice == nil || invoice.Status != INVOICE_PAID {
+		t.Fatalf("expected a paid invoice to be kept, got %+v", invoice)
+	}
+
+	if !slices.Contains(GetUserClaims(pubkey), PAID_CLAIM) {
+		t.Fatalf("expected the missed payment to grant membership")
+	}
+
+	if GetInvoice(recent.ID) == nil {
+		t.Fatalf("expected recent invoices to be kept")
+	}
+}
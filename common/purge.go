@@ -0,0 +1,133 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// What to do with a pubkey's existing content when it's banned. Hidden events are left out of
+// query results for as long as the ban lasts, while deleted ones are gone for good.
+
+const (
+	PURGE_NONE   = "none"
+	PURGE_HIDE   = "hide"
+	PURGE_DELETE = "delete"
+)
+
+var PURGE_MODES = []string{PURGE_NONE, PURGE_HIDE, PURGE_DELETE}
+
+// PurgeHooks delete content stored outside of the event store, such as blossom uploads. Each
+// is named after what it deletes, and returns how many items it deleted.
+var PurgeHooks = make(map[string]func(ctx context.Context, pubkey string) (int, error))
+
+func IsHidden(pubkey string) bool {
+	ban := GetBan(pubkey)
+
+	return ban != nil && ban.Purge == PURGE_HIDE
+}
+
+// PurgePubKey deletes everything pubkey has published, removes them from groups, and runs
+// PurgeHooks. It runs in the background, reporting progress to the audit log.
+func PurgePubKey(actor string, pubkey string) {
+	go func() {
+		ctx := context.Background()
+
+		Audit(actor, "purgepubkey", pubkey, "started")
+
+		if count, err := purgeEvents(ctx, pubkey); err != nil {
+			Audit(actor, "purgepubkey", pubkey, fmt.Sprintf("failed to delete events: %v", err))
+		} else {
+			Audit(actor, "purgepubkey", pubkey, fmt.Sprintf("deleted %d events", count))
+		}
+
+		if RELAY_ENABLE_GROUPS {
+			count := purgeGroupMemberships(ctx, pubkey)
+			Audit(actor, "purgepubkey", pubkey, fmt.Sprintf("removed from %d groups", count))
+		}
+
+		for name, hook := range PurgeHooks {
+			if count, err := hook(ctx, pubkey); err != nil {
+				Audit(actor, "purgepubkey", pubkey, fmt.Sprintf("failed to delete %s: %v", name, err))
+			} else {
+				Audit(actor, "purgepubkey", pubkey, fmt.Sprintf("deleted %d %s", count, name))
+			}
+		}
+
+		Audit(actor, "purgepubkey", pubkey, "completed")
+	}()
+}
+
+func purgeEvents(ctx context.Context, pubkey string) (int, error) {
+	count := 0
+	filter := nostr.Filter{
+		Authors: []string{pubkey},
+		Limit:   1000,
+	}
+
+	deleted := make(map[string]bool)
+
+	// Events are deleted as we go, so just keep querying until there are none left, or until
+	// nothing but events we've already deleted comes back
+	for {
+		ch, err := GetBackend().QueryEvents(ctx, filter)
+		if err != nil {
+			return count, err
+		}
+
+		events := make([]*nostr.Event, 0)
+		for event := range ch {
+			events = append(events, event)
+		}
+
+		if len(events) == 0 {
+			return count, nil
+		}
+
+		progress := false
+
+		for _, event := range events {
+			if deleted[event.ID] {
+				continue
+			}
+
+			if err := DeleteEvent(ctx, event); err != nil {
+				return count, err
+			}
+
+			deleted[event.ID] = true
+			progress = true
+			count++
+		}
+
+		if !progress {
+			return count, fmt.Errorf("%d events were not deleted", len(events))
+		}
+	}
+}
+
+func purgeGroupMemberships(ctx context.Context, pubkey string) int {
+	count := 0
+
+	for _, group := range ListGroups() {
+		if !IsGroupMember(ctx, group.Address.ID, pubkey) {
+			continue
+		}
+
+		removeUserEvent := MakeRemoveUserEvent(&nostr.Event{
+			PubKey: pubkey,
+			Tags:   nostr.Tags{nostr.Tag{"h", group.Address.ID}},
+		})
+
+		if err := GetBackend().SaveEvent(ctx, removeUserEvent); err != nil {
+			log.Println(err)
+		} else {
+			GetRelay().BroadcastEvent(removeUserEvent)
+			count++
+		}
+	}
+
+	return count
+}
@@ -12,25 +12,30 @@ import (
 )
 
 var (
-	relay     *khatru.Relay
-	relayOnce sync.Once
+	relay       *khatru.Relay
+	relayOnce   sync.Once
+	migrateOnce sync.Once
 )
 
 func GetRelay() *khatru.Relay {
 	relayOnce.Do(func() {
 		relay = khatru.NewRelay()
-		relay.Info.Name = RELAY_NAME
-		relay.Info.Icon = RELAY_ICON
-		// relay.Info.Self = RELAY_SELF
 		relay.Info.PubKey = First(RELAY_ADMINS)
-		relay.Info.Description = RELAY_DESCRIPTION
 		relay.Info.Software = "https://github.com/coracle-social/frith"
 		relay.Info.Version = "v0.1.0"
 
+		relay.Info.SupportedNIPs = append(relay.Info.SupportedNIPs, 43)
+
+		loadRelayInfo()
+
 		if RELAY_ENABLE_GROUPS {
 			relay.Info.SupportedNIPs = append(relay.Info.SupportedNIPs, 29)
 		}
 
+		relay.OverwriteRelayInformation = append(relay.OverwriteRelayInformation, OverwriteRelayInformation)
+		relay.RejectConnection = append(relay.RejectConnection, RejectConnection)
+		relay.OnConnect = append(relay.OnConnect, TrackConnection)
+		relay.OnDisconnect = append(relay.OnDisconnect, UntrackConnection)
 		relay.OnConnect = append(relay.OnConnect, khatru.RequestAuth)
 		relay.RejectFilter = append(relay.RejectFilter, RejectFilter)
 		relay.QueryEvents = append(relay.QueryEvents, QueryEvents)
@@ -38,11 +43,22 @@ func GetRelay() *khatru.Relay {
 		relay.RejectEvent = append(relay.RejectEvent, RejectEvent)
 		relay.StoreEvent = append(relay.StoreEvent, SaveEvent)
 		relay.OnEventSaved = append(relay.OnEventSaved, OnEventSaved)
+		relay.OnEphemeralEvent = append(relay.OnEphemeralEvent, OnEphemeralEvent)
+		relay.PreventBroadcast = append(relay.PreventBroadcast, PreventBroadcast)
+		relay.PreventBroadcast = append(relay.PreventBroadcast, PreventShadowedBroadcast)
+		relay.PreventBroadcast = append(relay.PreventBroadcast, PreventLabelBroadcast)
 
 		enableManaagementApi(relay)
+		enablePayments(relay)
+
+		// khatru appends to the supported NIPs of a shallow copy of relay.Info when serving NIP 11,
+		// so leave no spare capacity for concurrent requests to write into
+		relay.Info.SupportedNIPs = slices.Clip(relay.Info.SupportedNIPs)
 	})
 
-	migrateGroups()
+	// Run this outside of relayOnce, since migrating calls OnEventSaved, which may need the relay
+	migrateOnce.Do(migrateGroups)
+	inviteIndexOnce.Do(migrateInviteIndex)
 
 	return relay
 }
@@ -96,7 +112,7 @@ func migrateGroup(ctx context.Context, id string) error {
 		},
 	}
 
-	if err := createEvent.Sign(RELAY_SECRET); err != nil {
+	if err := SignAsRelay(createEvent); err != nil {
 		return fmt.Errorf("failed to sign create group event: %w", err)
 	}
 
@@ -117,7 +133,7 @@ func migrateGroup(ctx context.Context, id string) error {
 			},
 		}
 
-		if err := editEvent.Sign(RELAY_SECRET); err != nil {
+		if err := SignAsRelay(editEvent); err != nil {
 			return fmt.Errorf("failed to sign edit metadata event: %w", err)
 		}
 
@@ -0,0 +1,103 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/nbd-wtf/go-nostr/nip11"
+)
+
+// Relay information set through NIP 86, which takes precedence over RELAY_NAME,
+// RELAY_DESCRIPTION and RELAY_ICON. khatru reads relay.Info on every NIP 11 request without
+// locking, so rather than changing it, overrides are applied to each response's copy.
+
+const (
+	RELAY_INFO_NAME        = "name"
+	RELAY_INFO_DESCRIPTION = "description"
+	RELAY_INFO_ICON        = "icon"
+)
+
+func GetRelayInfoOverride(field string) (string, bool) {
+	data := GetItem("relayinfo", field)
+	if data == nil {
+		return "", false
+	}
+
+	return string(data), true
+}
+
+// SetRelayInfo overrides a field of the relay information document. Setting an empty value
+// reverts to the one configured in the environment.
+func SetRelayInfo(field string, value string) error {
+	if field == RELAY_INFO_ICON && value != "" {
+		if u, err := url.Parse(value); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid icon url")
+		}
+	}
+
+	if value == "" {
+		DeleteItem("relayinfo", field)
+	} else {
+		PutItem("relayinfo", field, []byte(value))
+	}
+
+	loadRelayInfo()
+
+	return nil
+}
+
+type RelayInfo struct {
+	Name        string
+	Description string
+	Icon        string
+}
+
+var (
+	relay_info     RelayInfo
+	relay_infoLock sync.RWMutex
+)
+
+// GetRelayInfo returns the relay's name, description and icon, including any overrides
+func GetRelayInfo() RelayInfo {
+	relay_infoLock.RLock()
+	defer relay_infoLock.RUnlock()
+
+	return relay_info
+}
+
+func loadRelayInfo() {
+	info := RelayInfo{
+		Name:        RELAY_NAME,
+		Description: RELAY_DESCRIPTION,
+		Icon:        RELAY_ICON,
+	}
+
+	if name, ok := GetRelayInfoOverride(RELAY_INFO_NAME); ok {
+		info.Name = name
+	}
+
+	if description, ok := GetRelayInfoOverride(RELAY_INFO_DESCRIPTION); ok {
+		info.Description = description
+	}
+
+	if icon, ok := GetRelayInfoOverride(RELAY_INFO_ICON); ok {
+		info.Icon = icon
+	}
+
+	relay_infoLock.Lock()
+	relay_info = info
+	relay_infoLock.Unlock()
+}
+
+func OverwriteRelayInformation(ctx context.Context, r *http.Request, info nip11.RelayInformationDocument) nip11.RelayInformationDocument {
+	current := GetRelayInfo()
+
+	info.Name = current.Name
+	info.Description = current.Description
+	info.Icon = current.Icon
+
+	return info
+}
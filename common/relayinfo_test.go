@@ -0,0 +1,59 @@
+package common
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr/nip11"
+)
+
+func TestRelayInfoOverrides(t *testing.T) {
+	relay := GetRelay()
+	defer SetRelayInfo(RELAY_INFO_NAME, "")
+
+	fetch := func() nip11.RelayInformationDocument {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept", "application/nostr+json")
+
+		w := httptest.NewRecorder()
+		relay.ServeHTTP(w, r)
+
+		var info nip11.RelayInformationDocument
+		if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil {
+			t.Errorf("invalid relay information document: %v", err)
+		}
+
+		return info
+	}
+
+	// Overrides may change while information documents are being served
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			SetRelayInfo(RELAY_INFO_NAME, RandomString(8))
+		}()
+		go func() {
+			defer wg.Done()
+			fetch()
+		}()
+	}
+	wg.Wait()
+
+	if err := SetRelayInfo(RELAY_INFO_NAME, "Overridden"); err != nil {
+		t.Fatal(err)
+	}
+
+	if info := fetch(); info.Name != "Overridden" || GetRelayInfo().Name != "Overridden" {
+		t.Fatalf("expected the override to be served, got %q", info.Name)
+	}
+
+	SetRelayInfo(RELAY_INFO_NAME, "")
+
+	if info := fetch(); info.Name != RELAY_NAME {
+		t.Fatalf("expected clearing the override to restore %q, got %q", RELAY_NAME, info.Name)
+	}
+}
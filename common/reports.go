@@ -0,0 +1,355 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// NIP 56 reports, indexed as they arrive and grouped into cases by whatever they're about:
+// the reported event if there is one, otherwise the reported pubkey. Cases stay open until a
+// moderator resolves them, and are reopened if further reports come in afterwards.
+
+const (
+	REPORT_OPEN      = "open"
+	REPORT_RESOLVING = "resolving"
+	REPORT_RESOLVED  = "resolved"
+)
+
+const (
+	REPORT_TARGET_EVENT  = "event"
+	REPORT_TARGET_PUBKEY = "pubkey"
+)
+
+const (
+	REPORT_DISMISS           = "dismiss"
+	REPORT_BAN_EVENT         = "banevent"
+	REPORT_BAN_PUBKEY        = "banpubkey"
+	REPORT_REMOVE_FROM_GROUP = "removefromgroup"
+)
+
+// Cases claimed by a moderator for longer than this, for example because the relay restarted
+// while acting on them, may be claimed again
+const REPORT_CLAIM_TIMEOUT = 10 * time.Minute
+
+var REPORT_ACTIONS = []string{REPORT_DISMISS, REPORT_BAN_EVENT, REPORT_BAN_PUBKEY, REPORT_REMOVE_FROM_GROUP}
+
+var report_lock sync.Mutex
+
+type Report struct {
+	ID        string          `json:"id"`
+	Reporter  string          `json:"reporter"`
+	Type      string          `json:"type,omitempty"`
+	Content   string          `json:"content,omitempty"`
+	CreatedAt nostr.Timestamp `json:"created_at"`
+}
+
+type ReportResolution struct {
+	Actor      string          `json:"actor"`
+	Action     string          `json:"action"`
+	Reason     string          `json:"reason,omitempty"`
+	ResolvedAt nostr.Timestamp `json:"resolved_at"`
+}
+
+type ReportCase struct {
+	Target     string            `json:"target"`
+	TargetType string            `json:"target_type"`
+	PubKey     string            `json:"pubkey"`
+	Group      string            `json:"group,omitempty"`
+	Status     string            `json:"status"`
+	ClaimedAt  nostr.Timestamp   `json:"claimed_at,omitempty"`
+	Reports    []Report          `json:"reports"`
+	Resolution *ReportResolution `json:"resolution,omitempty"`
+	CreatedAt  nostr.Timestamp   `json:"created_at"`
+	UpdatedAt  nostr.Timestamp   `json:"updated_at"`
+}
+
+func (c ReportCase) Reporters() []string {
+	reporters := make([]string, 0)
+
+	for _, report := range c.Reports {
+		if !slices.Contains(reporters, report.Reporter) {
+			reporters = append(reporters, report.Reporter)
+		}
+	}
+
+	return reporters
+}
+
+func GetReportCase(target string) *ReportCase {
+	var c ReportCase
+
+	if err := json.Unmarshal(GetItem("report", target), &c); err != nil {
+		return nil
+	}
+
+	return &c
+}
+
+func PutReportCase(c ReportCase) {
+	data, err := json.Marshal(c)
+	if err != nil {
+		log.Println(err)
+	} else {
+		PutItem("report", c.Target, data)
+	}
+}
+
+func ListReportCases(status string) []ReportCase {
+	cases := make([]ReportCase, 0)
+
+	for _, item := range ListItems("report") {
+		var c ReportCase
+
+		if err := json.Unmarshal([]byte(item), &c); err != nil {
+			log.Printf("Failed to unmarshal report %v %s", err, item)
+			continue
+		}
+
+		if status == "" || c.Status == status {
+			cases = append(cases, c)
+		}
+	}
+
+	slices.SortFunc(cases, func(a, b ReportCase) int {
+		return int(a.UpdatedAt - b.UpdatedAt)
+	})
+
+	return cases
+}
+
+// IndexReport adds a kind 1984 event to the case for whatever it reports
+func IndexReport(ctx context.Context, event *nostr.Event) {
+	pTag := event.Tags.GetFirst([]string{"p", ""})
+	if pTag == nil || !nostr.IsValidPublicKey((*pTag)[1]) {
+		return
+	}
+
+	target := (*pTag)[1]
+	targetType := REPORT_TARGET_PUBKEY
+	reportType := ""
+
+	if len(*pTag) > 2 {
+		reportType = (*pTag)[2]
+	}
+
+	if eTag := event.Tags.GetFirst([]string{"e", ""}); eTag != nil && nostr.IsValid32ByteHex((*eTag)[1]) {
+		target = (*eTag)[1]
+		targetType = REPORT_TARGET_EVENT
+
+		if len(*eTag) > 2 {
+			reportType = (*eTag)[2]
+		}
+	}
+
+	report_lock.Lock()
+	defer report_lock.Unlock()
+
+	c := GetReportCase(target)
+	if c == nil {
+		c = &ReportCase{
+			Target:     target,
+			TargetType: targetType,
+			PubKey:     (*pTag)[1],
+			Group:      getReportedGroup(ctx, event, target, targetType),
+			CreatedAt:  nostr.Now(),
+		}
+	}
+
+	// Saved events may be replayed on startup, so don't count the same report twice
+	if slices.ContainsFunc(c.Reports, func(report Report) bool { return report.ID == event.ID }) {
+		return
+	}
+
+	c.Reports = append(c.Reports, Report{
+		ID:        event.ID,
+		Reporter:  event.PubKey,
+		Type:      reportType,
+		Content:   event.Content,
+		CreatedAt: event.CreatedAt,
+	})
+
+	// A moderator acting on the case will close it along with the new report
+	if c.Status != REPORT_RESOLVING {
+		c.Status = REPORT_OPEN
+	}
+
+	c.UpdatedAt = nostr.Now()
+
+	PutReportCase(*c)
+}
+
+// getReportedGroup finds the group a report is about, either from the report itself or from
+// the reported event
+func getReportedGroup(ctx context.Context, event *nostr.Event, target string, targetType string) string {
+	if h := GetGroupIDFromEvent(event); h != "" {
+		return h
+	}
+
+	if targetType != REPORT_TARGET_EVENT {
+		return ""
+	}
+
+	ch, err := GetBackend().QueryEvents(ctx, nostr.Filter{IDs: []string{target}})
+	if err != nil {
+		log.Println(err)
+		return ""
+	}
+
+	for reported := range ch {
+		return GetGroupIDFromEvent(reported)
+	}
+
+	return ""
+}
+
+// ResolveReport closes a case, taking action against whatever was reported. Moderators need
+// permission to take the action as well as to resolve reports.
+func ResolveReport(ctx context.Context, actor string, target string, action string, reason string, notify bool) (*ReportCase, error) {
+	if !slices.Contains(REPORT_ACTIONS, action) {
+		return nil, fmt.Errorf("invalid action param, expected one of %v", REPORT_ACTIONS)
+	}
+
+	if action != REPORT_DISMISS && !CanCallMethod(actor, action) {
+		return nil, fmt.Errorf("you are not allowed to call %s", action)
+	}
+
+	c, err := claimReportCase(target)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := actOnReport(ctx, actor, *c, action, reason); err != nil {
+		releaseReportCase(target)
+		return nil, err
+	}
+
+	report_lock.Lock()
+	defer report_lock.Unlock()
+
+	// Re-read the case, in case more reports came in while acting on it
+	if latest := GetReportCase(target); latest != nil {
+		c = latest
+	}
+
+	c.Status = REPORT_RESOLVED
+	c.ClaimedAt = 0
+	c.UpdatedAt = nostr.Now()
+	c.Resolution = &ReportResolution{
+		Actor:      actor,
+		Action:     action,
+		Reason:     reason,
+		ResolvedAt: nostr.Now(),
+	}
+
+	PutReportCase(*c)
+
+	if notify {
+		go NotifyReporters(*c)
+	}
+
+	return c, nil
+}
+
+// claimReportCase marks an open case as being resolved, so that only one moderator acts on it
+func claimReportCase(target string) (*ReportCase, error) {
+	report_lock.Lock()
+	defer report_lock.Unlock()
+
+	c := GetReportCase(target)
+	if c == nil {
+		return nil, fmt.Errorf("no report found for this target")
+	}
+
+	stale := c.Status == REPORT_RESOLVING && c.ClaimedAt.Time().Add(REPORT_CLAIM_TIMEOUT).Before(time.Now())
+
+	if c.Status != REPORT_OPEN && !stale {
+		return nil, fmt.Errorf("report has already been %s", c.Status)
+	}
+
+	c.Status = REPORT_RESOLVING
+	c.ClaimedAt = nostr.Now()
+	PutReportCase(*c)
+
+	return c, nil
+}
+
+// releaseReportCase reopens a case after acting on it failed
+func releaseReportCase(target string) {
+	report_lock.Lock()
+	defer report_lock.Unlock()
+
+	if c := GetReportCase(target); c != nil && c.Status == REPORT_RESOLVING {
+		c.Status = REPORT_OPEN
+		c.ClaimedAt = 0
+		PutReportCase(*c)
+	}
+}
+
+func actOnReport(ctx context.Context, actor string, c ReportCase, action string, reason string) error {
+	relay := GetRelay()
+
+	switch action {
+	case REPORT_BAN_EVENT:
+		if c.TargetType != REPORT_TARGET_EVENT {
+			return fmt.Errorf("report is not about an event")
+		}
+
+		return relay.ManagementAPI.BanEvent(ctx, c.Target, reason)
+	case REPORT_BAN_PUBKEY:
+		return relay.ManagementAPI.BanPubKey(ctx, c.PubKey, reason)
+	case REPORT_REMOVE_FROM_GROUP:
+		if c.Group == "" {
+			return fmt.Errorf("report is not about a group")
+		}
+
+		if !CanModerate(actor, c.PubKey) {
+			return fmt.Errorf("blocked: only relay admins can act against admins or moderators")
+		}
+
+		removeUserEvent := MakeRemoveUserEvent(&nostr.Event{
+			PubKey: c.PubKey,
+			Tags:   nostr.Tags{nostr.Tag{"h", c.Group}},
+		})
+
+		if err := GetBackend().SaveEvent(ctx, removeUserEvent); err != nil {
+			return fmt.Errorf("internal error: failed to remove user from group")
+		}
+
+		relay.BroadcastEvent(removeUserEvent)
+		AuditGroupModeration(removeUserEvent)
+	}
+
+	return nil
+}
+
+var REPORT_OUTCOMES = map[string]string{
+	REPORT_DISMISS:           "decided not to take any action",
+	REPORT_BAN_EVENT:         "removed the reported content",
+	REPORT_BAN_PUBKEY:        "banned the reported account",
+	REPORT_REMOVE_FROM_GROUP: "removed the reported account from the group",
+}
+
+// NotifyReporters lets everyone who reported something know how their report was resolved
+func NotifyReporters(c ReportCase) {
+	if c.Resolution == nil {
+		return
+	}
+
+	message := fmt.Sprintf("Thanks for your report. A moderator on %s reviewed it and %s.", GetRelayInfo().Name, REPORT_OUTCOMES[c.Resolution.Action])
+	if c.Resolution.Reason != "" {
+		message += "\n\nReason: " + c.Resolution.Reason
+	}
+
+	for _, reporter := range c.Reporters() {
+		if err := SendDirectMessageAsRelay(context.Background(), reporter, message); err != nil {
+			log.Printf("Failed to notify reporter %s: %v", reporter, err)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package common
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// fileReport saves a report about pubkey and returns the case target
+func fileReport(t *testing.T, pubkey string) string {
+	reporterSecret, _ := testKeypair()
+
+	report := &nostr.Event{
+		Kind:      nostr.KindReporting,
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{{"p", pubkey, "spam"}},
+	}
+	report.Sign(reporterSecret)
+
+	IndexReport(context.Background(), report)
+
+	if c := GetReportCase(pubkey); c == nil || c.Status != REPORT_OPEN {
+		t.Fatalf("expected an open case, got %+v", c)
+	}
+
+	return pubkey
+}
+
+func asManager(pubkey string) context.Context {
+	return context.WithValue(context.Background(), managementAuthKey{}, pubkey)
+}
+
+func TestResolveReportPermissions(t *testing.T) {
+	_, moderator := testKeypair()
+	_, reported := testKeypair()
+
+	GrantModerator(moderator, []string{"reports"})
+	defer RevokeModerator(moderator, nil)
+
+	target := fileReport(t, reported)
+	ctx := asManager(moderator)
+
+	for _, action := range []string{REPORT_BAN_PUBKEY, REPORT_BAN_EVENT, REPORT_REMOVE_FROM_GROUP} {
+		if _, err := ResolveReport(ctx, moderator, target, action, "", false); err == nil || !strings.Contains(err.Error(), "not allowed") {
+			t.Fatalf("expected %s to require permission, got %v", action, err)
+		}
+	}
+
+	if GetReportCase(target).Status != REPORT_OPEN {
+		t.Fatalf("refused actions shouldn't close the case")
+	}
+
+	if _, err := ResolveReport(ctx, moderator, target, REPORT_DISMISS, "not spam", false); err != nil {
+		t.Fatal(err)
+	}
+
+	if c := GetReportCase(target); c.Status != REPORT_RESOLVED || c.Resolution.Actor != moderator {
+		t.Fatalf("expected the case to be resolved by the moderator, got %+v", c)
+	}
+
+	if _, err := ResolveReport(ctx, moderator, target, REPORT_DISMISS, "", false); err == nil {
+		t.Fatalf("expected resolving twice to fail")
+	}
+}
+
+func TestResolveReportProtectsAdmins(t *testing.T) {
+	_, moderator := testKeypair()
+
+	GrantModerator(moderator, []string{"reports", "banpubkey"})
+	defer RevokeModerator(moderator, nil)
+
+	target := fileReport(t, testAdmin)
+	defer DeleteItem("report", target)
+
+	if _, err := ResolveReport(asManager(moderator), moderator, target, REPORT_BAN_PUBKEY, "", false); err == nil {
+		t.Fatalf("expected a moderator to be refused banning an admin")
+	}
+
+	if IsBanned(testAdmin) {
+		t.Fatalf("admin was banned")
+	}
+
+	if GetReportCase(target).Status != REPORT_OPEN {
+		t.Fatalf("expected the case to be reopened after the action failed")
+	}
+}
+
+func TestResolveReportOnlyOnce(t *testing.T) {
+	_, reported := testKeypair()
+	target := fileReport(t, reported)
+
+	var resolved atomic.Int32
+	var wg sync.WaitGroup
+
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			if _, err := ResolveReport(asManager(testAdmin), testAdmin, target, REPORT_DISMISS, "", false); err == nil {
+				resolved.Add(1)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if n := resolved.Load(); n != 1 {
+		t.Fatalf("expected the case to be resolved once, got %d", n)
+	}
+}
+
+func TestStaleReportClaimsCanBeReclaimed(t *testing.T) {
+	_, reported := testKeypair()
+	target := fileReport(t, reported)
+
+	if _, err := claimReportCase(target); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ResolveReport(asManager(testAdmin), testAdmin, target, REPORT_DISMISS, "", false); err == nil {
+		t.Fatalf("expected a case being resolved to be refused")
+	}
+
+	// Pretend whoever claimed the case went away without resolving it
+	c := GetReportCase(target)
+	c.ClaimedAt = nostr.Now() - nostr.Timestamp(REPORT_CLAIM_TIMEOUT.Seconds()) - 1
+	PutReportCase(*c)
+
+	if c, err := ResolveReport(asManager(testAdmin), testAdmin, target, REPORT_DISMISS, "", false); err != nil || c.Status != REPORT_RESOLVED {
+		t.Fatalf("expected a stale claim to be reclaimed, got %v", err)
+	}
+}
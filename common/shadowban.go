@@ -0,0 +1,110 @@
+package common
+
+import (
+	"slices"
+	"sync"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Shadow-banned pubkeys can keep publishing, but nobody other than themselves, relay admins, and
+// moderators who can shadow-ban gets to see it. Events published while shadow-banned are
+// flagged, and stay hidden even after the shadow-ban is lifted, while earlier events stay visible.
+
+// Flagged event ids are kept in memory, since every query result is checked against them
+var (
+	shadowed_events     map[string]string
+	shadowed_eventsLock sync.RWMutex
+	shadowed_eventsOnce sync.Once
+)
+
+func loadShadowedEvents() {
+	shadowed_eventsLock.Lock()
+	shadowed_events = ListItems("shadowedevent")
+	shadowed_eventsLock.Unlock()
+}
+
+func IsShadowBanned(pubkey string) bool {
+	return HasItem("shadowbannedpubkey", pubkey)
+}
+
+func ShadowBanPubKey(pubkey string, reason string) {
+	PutItem("shadowbannedpubkey", pubkey, []byte(reason))
+}
+
+func UnshadowBanPubKey(pubkey string) {
+	DeleteItem("shadowbannedpubkey", pubkey)
+}
+
+// GetShadowedOwner returns the shadow-banned pubkey an event was hidden on behalf of, if any
+func GetShadowedOwner(event *nostr.Event) string {
+	shadowed_eventsOnce.Do(loadShadowedEvents)
+
+	shadowed_eventsLock.RLock()
+	defer shadowed_eventsLock.RUnlock()
+
+	return shadowed_events[event.ID]
+}
+
+func IsShadowed(event *nostr.Event) bool {
+	shadowed_eventsOnce.Do(loadShadowedEvents)
+
+	shadowed_eventsLock.RLock()
+	defer shadowed_eventsLock.RUnlock()
+
+	_, ok := shadowed_events[event.ID]
+
+	return ok
+}
+
+// CanReviewShadowed decides whether pubkey may see content hidden by shadow-bans
+func CanReviewShadowed(pubkey string) bool {
+	return pubkey != "" && CanCallMethod(pubkey, "shadowbanpubkey")
+}
+
+// CanSeeEvent decides whether pubkey may see an event, taking shadow-bans into account
+func CanSeeEvent(pubkey string, event *nostr.Event) bool {
+	if pubkey == event.PubKey || slices.Contains(RELAY_ADMINS, pubkey) || !IsShadowed(event) {
+		return true
+	}
+
+	return pubkey == GetShadowedOwner(event) || CanReviewShadowed(pubkey)
+}
+
+func FlagShadowedEvent(event *nostr.Event) {
+	if IsShadowBanned(event.PubKey) {
+		FlagShadowedEventFor(event, event.PubKey)
+	}
+}
+
+// FlagShadowedEventFor hides an event published by the relay on behalf of a shadow-banned pubkey
+func FlagShadowedEventFor(event *nostr.Event, pubkey string) {
+	shadowed_eventsOnce.Do(loadShadowedEvents)
+
+	shadowed_eventsLock.Lock()
+	defer shadowed_eventsLock.Unlock()
+
+	PutItem("shadowedevent", event.ID, []byte(pubkey))
+	shadowed_events[event.ID] = pubkey
+}
+
+func UnflagShadowedEvent(event *nostr.Event) {
+	shadowed_eventsOnce.Do(loadShadowedEvents)
+
+	shadowed_eventsLock.Lock()
+	defer shadowed_eventsLock.Unlock()
+
+	DeleteItem("shadowedevent", event.ID)
+	delete(shadowed_events, event.ID)
+}
+
+func PreventShadowedBroadcast(ws *khatru.WebSocket, event *nostr.Event) bool {
+	if !CanSeeEvent(ws.AuthedPublicKey, event) {
+		return true
+	}
+
+	// Ephemeral events are never flagged, since they aren't stored
+	return IsShadowBanned(event.PubKey) && ws.AuthedPublicKey != event.PubKey &&
+		!slices.Contains(RELAY_ADMINS, ws.AuthedPublicKey) && !CanReviewShadowed(ws.AuthedPublicKey)
+}
@@ -0,0 +1,53 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestShadowBanVisibility(t *testing.T) {
+	_, author := testKeypair()
+	_, viewer := testKeypair()
+	_, moderator := testKeypair()
+
+	GrantModerator(moderator, []string{"banpubkey"})
+	defer RevokeModerator(moderator, nil)
+
+	before := &nostr.Event{ID: RandomString(16), PubKey: author}
+	FlagShadowedEvent(before)
+
+	ShadowBanPubKey(author, "spam")
+	defer UnshadowBanPubKey(author)
+
+	during := &nostr.Event{ID: RandomString(16), PubKey: author}
+	FlagShadowedEvent(during)
+
+	if !CanSeeEvent(viewer, before) {
+		t.Fatalf("events published before the shadow ban should stay visible")
+	}
+
+	if CanSeeEvent(viewer, during) {
+		t.Fatalf("events published during the shadow ban should be hidden")
+	}
+
+	for _, pubkey := range []string{author, testAdmin, moderator} {
+		if !CanSeeEvent(pubkey, during) {
+			t.Fatalf("%s should be able to see shadowed events", pubkey)
+		}
+	}
+
+	UnshadowBanPubKey(author)
+
+	if CanSeeEvent(viewer, during) {
+		t.Fatalf("events published during the shadow ban should stay hidden after it is lifted")
+	}
+
+	// Events published by the relay on behalf of a shadow-banned pubkey are visible to them
+	putUser := &nostr.Event{ID: RandomString(16), PubKey: RELAY_SELF}
+	FlagShadowedEventFor(putUser, author)
+
+	if !CanSeeEvent(author, putUser) || CanSeeEvent(viewer, putUser) {
+		t.Fatalf("expected relay events flagged for a pubkey to only be visible to them")
+	}
+}
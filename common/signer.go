@@ -0,0 +1,240 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip17"
+	"github.com/nbd-wtf/go-nostr/nip44"
+	"github.com/nbd-wtf/go-nostr/nip46"
+	"github.com/nbd-wtf/go-nostr/nip49"
+)
+
+// Everything the relay publishes is signed via relay_signer, which is backed by one of:
+//
+// - a NIP 46 remote signer, if RELAY_BUNKER is set
+// - a NIP 49 encrypted key, if RELAY_NCRYPTSEC is set, unlocked using RELAY_PASSPHRASE_FILE
+// - a raw key, taken from RELAY_SECRET or DATA_DIR
+
+var relay_signer nostr.Keyer
+
+func SetupRelaySigner() string {
+	var err error
+
+	switch {
+	case RELAY_BUNKER != "":
+		relay_signer, err = newBunkerSigner(RELAY_BUNKER)
+	case RELAY_NCRYPTSEC != "":
+		relay_signer, err = newEncryptedKeySigner(RELAY_NCRYPTSEC, RELAY_PASSPHRASE_FILE)
+	default:
+		if RELAY_SECRET == "" {
+			RELAY_SECRET = LoadOrCreateRelaySecret()
+		}
+
+		relay_signer, err = newKeySigner(RELAY_SECRET)
+	}
+
+	if err != nil {
+		log.Fatal("Failed to set up relay signer: ", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	pubkey, err := relay_signer.GetPublicKey(ctx)
+	if err != nil {
+		log.Fatal("Failed to get relay pubkey: ", err)
+	}
+
+	return pubkey
+}
+
+func SignAsRelay(event *nostr.Event) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	return relay_signer.SignEvent(ctx, event)
+}
+
+// SendDirectMessageAsRelay sends a NIP 17 direct message from the relay to pubkey. The gift
+// wrap is stored on this relay, since that's where recipients are known to be reading from.
+func SendDirectMessageAsRelay(ctx context.Context, pubkey string, content string) error {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	_, toThem, err := nip17.PrepareMessage(ctx, content, nostr.Tags{}, relay_signer, pubkey, nil)
+	if err != nil {
+		return err
+	}
+
+	if err := GetBackend().SaveEvent(ctx, &toThem); err != nil {
+		return err
+	}
+
+	GetRelay().BroadcastEvent(&toThem)
+
+	return nil
+}
+
+type keySigner struct {
+	secret string
+	pubkey string
+}
+
+func newKeySigner(secret string) (nostr.Keyer, error) {
+	pubkey, err := nostr.GetPublicKey(secret)
+	if err != nil {
+		return nil, fmt.Errorf("invalid secret: %w", err)
+	}
+
+	return &keySigner{secret: secret, pubkey: pubkey}, nil
+}
+
+func (s *keySigner) GetPublicKey(ctx context.Context) (string, error) {
+	return s.pubkey, nil
+}
+
+func (s *keySigner) SignEvent(ctx context.Context, event *nostr.Event) error {
+	return event.Sign(s.secret)
+}
+
+func (s *keySigner) Encrypt(ctx context.Context, plaintext string, recipient string) (string, error) {
+	key, err := nip44.GenerateConversationKey(recipient, s.secret)
+	if err != nil {
+		return "", err
+	}
+
+	return nip44.Encrypt(plaintext, key)
+}
+
+func (s *keySigner) Decrypt(ctx context.Context, ciphertext string, sender string) (string, error) {
+	key, err := nip44.GenerateConversationKey(sender, s.secret)
+	if err != nil {
+		return "", err
+	}
+
+	return nip44.Decrypt(ciphertext, key)
+}
+
+func newEncryptedKeySigner(ncryptsec string, passphraseFile string) (nostr.Keyer, error) {
+	if passphraseFile == "" {
+		return nil, fmt.Errorf("RELAY_PASSPHRASE_FILE is required when using RELAY_NCRYPTSEC")
+	}
+
+	data, err := os.ReadFile(passphraseFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read passphrase: %w", err)
+	}
+
+	// Decrypting is deliberately slow, so only do it once rather than on every signature
+	secret, err := nip49.Decrypt(ncryptsec, strings.TrimRight(string(data), "\r\n"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt key: %w", err)
+	}
+
+	return newKeySigner(secret)
+}
+
+// Group metadata is re-signed on every query, so remember signatures to avoid a round trip
+// to the bunker each time.
+
+const bunkerSignatureCacheSize = 10000
+
+type bunkerSigner struct {
+	bunker     *nip46.BunkerClient
+	pubkey     string
+	mu         sync.Mutex
+	signatures map[string]string
+}
+
+func newBunkerSigner(bunkerURL string) (nostr.Keyer, error) {
+	parsed, err := url.Parse(bunkerURL)
+	if err != nil || parsed.Scheme != "bunker" || !nostr.IsValidPublicKey(parsed.Host) {
+		return nil, fmt.Errorf("invalid bunker url: %s", bunkerURL)
+	}
+
+	// Keep the client key stable so that the bunker only needs to authorize us once
+	clientSecret := loadOrCreateSecret(GetBunkerClientSecretPath())
+
+	// The bunker listens for responses for as long as its context lives, so only time out the handshake
+	bunker := nip46.NewBunker(
+		context.Background(),
+		clientSecret,
+		parsed.Host,
+		parsed.Query()["relay"],
+		nil,
+		func(authURL string) {
+			log.Println("Remote signer requires authorization at", authURL)
+		},
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if _, err := bunker.RPC(ctx, "connect", []string{parsed.Host, parsed.Query().Get("secret")}); err != nil {
+		return nil, fmt.Errorf("failed to connect to bunker: %w", err)
+	}
+
+	pubkey, err := bunker.GetPublicKey(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get pubkey from bunker: %w", err)
+	}
+
+	return &bunkerSigner{
+		bunker:     bunker,
+		pubkey:     pubkey,
+		signatures: make(map[string]string),
+	}, nil
+}
+
+func (s *bunkerSigner) GetPublicKey(ctx context.Context) (string, error) {
+	return s.pubkey, nil
+}
+
+func (s *bunkerSigner) SignEvent(ctx context.Context, event *nostr.Event) error {
+	event.PubKey = s.pubkey
+	id := event.GetID()
+
+	s.mu.Lock()
+	sig, ok := s.signatures[id]
+	s.mu.Unlock()
+
+	if ok {
+		event.ID = id
+		event.Sig = sig
+
+		return nil
+	}
+
+	if err := s.bunker.SignEvent(ctx, event); err != nil {
+		return err
+	}
+
+	if ok, err := event.CheckSignature(); !ok {
+		return fmt.Errorf("bunker returned an invalid signature: %v", err)
+	}
+
+	s.mu.Lock()
+	if len(s.signatures) >= bunkerSignatureCacheSize {
+		clear(s.signatures)
+	}
+	s.signatures[event.ID] = event.Sig
+	s.mu.Unlock()
+
+	return nil
+}
+
+func (s *bunkerSigner) Encrypt(ctx context.Context, plaintext string, recipient string) (string, error) {
+	return s.bunker.NIP44Encrypt(ctx, recipient, plaintext)
+}
+
+func (s *bunkerSigner) Decrypt(ctx context.Context, ciphertext string, sender string) (string, error) {
+	return s.bunker.NIP44Decrypt(ctx, sender, ciphertext)
+}
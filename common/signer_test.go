@@ -0,0 +1,185 @@
+package common
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip44"
+	"github.com/nbd-wtf/go-nostr/nip46"
+	"github.com/nbd-wtf/go-nostr/nip59"
+)
+
+// startTestBunker runs a NIP 46 signer for secret on an in-process relay, and returns its
+// bunker url along with a count of the signatures it has produced.
+func startTestBunker(t *testing.T, secret string) (string, *atomic.Int32) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	server := httptest.NewServer(khatru.NewRelay())
+	t.Cleanup(server.Close)
+
+	relayURL := "ws" + strings.TrimPrefix(server.URL, "http")
+	pubkey, _ := nostr.GetPublicKey(secret)
+
+	conn, err := nostr.RelayConnect(ctx, relayURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sub, err := conn.Subscribe(ctx, nostr.Filters{{
+		Kinds: []int{nostr.KindNostrConnect},
+		Tags:  nostr.TagMap{"p": []string{pubkey}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer := nip46.NewStaticKeySigner(secret)
+	signatures := &atomic.Int32{}
+
+	go func() {
+		for event := range sub.Events {
+			req, _, response, err := signer.HandleRequest(ctx, event)
+			if err != nil {
+				continue
+			}
+
+			if req.Method == "sign_event" {
+				signatures.Add(1)
+			}
+
+			conn.Publish(ctx, response)
+		}
+	}()
+
+	return "bunker://" + pubkey + "?relay=" + relayURL, signatures
+}
+
+func TestBunkerSigner(t *testing.T) {
+	secret, pubkey := testKeypair()
+	bunkerURL, signatures := startTestBunker(t, secret)
+
+	signer, err := newBunkerSigner(bunkerURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+
+	if actual, _ := signer.GetPublicKey(ctx); actual != pubkey {
+		t.Fatalf("expected pubkey %s, got %s", pubkey, actual)
+	}
+
+	for range 2 {
+		event := &nostr.Event{Kind: 1, CreatedAt: 1700000000, Content: "hello"}
+		if err := signer.SignEvent(ctx, event); err != nil {
+			t.Fatal(err)
+		}
+
+		if ok, _ := event.CheckSignature(); !ok || event.PubKey != pubkey {
+			t.Fatalf("invalid signature on %+v", event)
+		}
+	}
+
+	if n := signatures.Load(); n != 1 {
+		t.Fatalf("expected the second signature to come from the cache, bunker signed %d times", n)
+	}
+
+	otherSecret, otherPubkey := testKeypair()
+
+	ciphertext, err := signer.Encrypt(ctx, "secret message", otherPubkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, _ := nip44.GenerateConversationKey(pubkey, otherSecret)
+	if plaintext, err := nip44.Decrypt(ciphertext, key); err != nil || plaintext != "secret message" {
+		t.Fatalf("failed to decrypt bunker ciphertext: %v", err)
+	}
+
+	reply, _ := nip44.Encrypt("reply", key)
+	if plaintext, err := signer.Decrypt(ctx, reply, otherPubkey); err != nil || plaintext != "reply" {
+		t.Fatalf("bunker failed to decrypt: %v", err)
+	}
+}
+
+func TestInviteEventIsStable(t *testing.T) {
+	_, author := testKeypair()
+	claim := GenerateInvite(author)
+
+	first := MakeInviteEvent(author, claim)
+	second := MakeInviteEvent(author, claim)
+
+	if first.GetID() != second.GetID() {
+		t.Fatalf("expected invite events for the same claim to be identical")
+	}
+
+	// Invites indexed without a timestamp get one the first time they're requested
+	PutItem(getInviteIndexTable(author), claim, []byte{})
+
+	if MakeInviteEvent(author, claim).CreatedAt != MakeInviteEvent(author, claim).CreatedAt {
+		t.Fatalf("expected legacy invites to keep the timestamp they were given")
+	}
+}
+
+func TestKeySignerEncryption(t *testing.T) {
+	secret, pubkey := testKeypair()
+	otherSecret, otherPubkey := testKeypair()
+
+	signer, _ := newKeySigner(secret)
+	other, _ := newKeySigner(otherSecret)
+
+	ctx := context.Background()
+
+	ciphertext, err := signer.Encrypt(ctx, "secret message", otherPubkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if plaintext, err := other.Decrypt(ctx, ciphertext, pubkey); err != nil || plaintext != "secret message" {
+		t.Fatalf("failed to decrypt: %v", err)
+	}
+}
+
+func TestSendDirectMessageAsRelay(t *testing.T) {
+	recipientSecret, recipient := testKeypair()
+	keyer, _ := newKeySigner(recipientSecret)
+	ctx := context.Background()
+
+	if err := SendDirectMessageAsRelay(ctx, recipient, "your report was resolved"); err != nil {
+		t.Fatal(err)
+	}
+
+	ch, err := GetBackend().QueryEvents(ctx, nostr.Filter{
+		Kinds: []int{nostr.KindGiftWrap},
+		Tags:  nostr.TagMap{"p": []string{recipient}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	count := 0
+	for wrap := range ch {
+		rumor, err := nip59.GiftUnwrap(*wrap, func(sender string, ciphertext string) (string, error) {
+			return keyer.Decrypt(ctx, ciphertext, sender)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if rumor.PubKey != RELAY_SELF || rumor.Content != "your report was resolved" {
+			t.Fatalf("unexpected message %+v", rumor)
+		}
+
+		count++
+	}
+
+	if count != 1 {
+		t.Fatalf("expected a single gift wrap, got %d", count)
+	}
+}
@@ -0,0 +1,100 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Whitelist built from NIP 51 follow sets and contact lists published by relay admins
+
+var (
+	list_whitelist      = make(map[string]bool)
+	list_whitelist_mu   sync.RWMutex
+	list_whitelist_once sync.Once
+)
+
+func HasAccessUsingListWhitelist(pubkey string) bool {
+	list_whitelist_once.Do(RefreshListWhitelist)
+
+	list_whitelist_mu.RLock()
+	defer list_whitelist_mu.RUnlock()
+
+	return list_whitelist[pubkey]
+}
+
+func IsWhitelistEvent(event *nostr.Event) bool {
+	if !slices.Contains(RELAY_ADMINS, event.PubKey) {
+		return false
+	}
+
+	if event.Kind == nostr.KindFollowList {
+		return RELAY_WHITELIST_CONTACTS
+	}
+
+	if event.Kind == nostr.KindCategorizedPeopleList {
+		return slices.Contains(RELAY_WHITELIST_SETS, event.Tags.GetD())
+	}
+
+	return false
+}
+
+func GetWhitelistFilter() nostr.Filter {
+	kinds := make([]int, 0)
+
+	if RELAY_WHITELIST_CONTACTS {
+		kinds = append(kinds, nostr.KindFollowList)
+	}
+
+	if len(RELAY_WHITELIST_SETS) > 0 {
+		kinds = append(kinds, nostr.KindCategorizedPeopleList)
+	}
+
+	return nostr.Filter{
+		Kinds:   kinds,
+		Authors: RELAY_ADMINS,
+	}
+}
+
+// RefreshListWhitelist rebuilds the whitelist from the latest version of each admin list
+func RefreshListWhitelist() {
+	filter := GetWhitelistFilter()
+	latest := make(map[string]*nostr.Event)
+	whitelist := make(map[string]bool)
+
+	if len(filter.Kinds) > 0 && len(filter.Authors) > 0 {
+		ch, err := GetBackend().QueryEvents(context.Background(), filter)
+		if err != nil {
+			log.Println("failed to query whitelist events", err)
+			return
+		}
+
+		for event := range ch {
+			if !IsWhitelistEvent(event) {
+				continue
+			}
+
+			address := fmt.Sprintf("%d:%s:%s", event.Kind, event.PubKey, event.Tags.GetD())
+
+			if previous, ok := latest[address]; !ok || previous.CreatedAt < event.CreatedAt {
+				latest[address] = event
+			}
+		}
+	}
+
+	for _, event := range latest {
+		for _, tag := range event.Tags {
+			if len(tag) >= 2 && tag[0] == "p" && nostr.IsValidPublicKey(tag[1]) {
+				whitelist[tag[1]] = true
+			}
+		}
+	}
+
+	list_whitelist_mu.Lock()
+	list_whitelist = whitelist
+	list_whitelist_mu.Unlock()
+}
@@ -0,0 +1,209 @@
+package common
+
+import (
+	"context"
+	"log"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Web of trust computed from the contact lists stored on this relay, starting from the admins.
+// Contact lists are loaded lazily and kept in memory, so that a new contact list only requires
+// walking the graph again rather than reloading it. Only the lists of pubkeys whose follows
+// count towards the graph are kept, and changes to them are batched into a single walk. The
+// graph is always walked in the background, and nobody is trusted until the first walk finishes.
+
+const WOT_REFRESH_DELAY = 10 * time.Second
+
+// Contact lists are loaded this many authors at a time. Since they are replaceable, each
+// author has at most one, so this is also the query limit.
+const WOT_QUERY_CHUNK = 500
+
+var (
+	wot_follows    = make(map[string][]string)
+	wot_updated    = make(map[string]nostr.Timestamp)
+	wot_trusted    = make(map[string]int)
+	wot_mu         sync.RWMutex
+	wot_refresh_mu sync.Mutex
+	wot_once       sync.Once
+	wot_pending    atomic.Bool
+)
+
+func HasAccessUsingWoT(pubkey string) bool {
+	if RELAY_WOT_DEPTH <= 0 {
+		return false
+	}
+
+	startWoT()
+
+	wot_mu.RLock()
+	defer wot_mu.RUnlock()
+
+	_, ok := wot_trusted[pubkey]
+
+	return ok
+}
+
+// HandleContactList records a newly saved contact list if its author is close enough to the
+// admins for it to matter, and schedules another walk of the graph if their follows changed.
+func HandleContactList(event *nostr.Event) {
+	if RELAY_WOT_DEPTH <= 0 {
+		return
+	}
+
+	startWoT()
+
+	// Wait for any walk in progress without holding up the event
+	go func() {
+		wot_refresh_mu.Lock()
+		defer wot_refresh_mu.Unlock()
+
+		// If the first walk hasn't happened yet, it will load this contact list itself
+		wot_mu.RLock()
+		depth, ok := wot_trusted[event.PubKey]
+		wot_mu.RUnlock()
+
+		if !ok || depth >= RELAY_WOT_DEPTH || event.CreatedAt < wot_updated[event.PubKey] {
+			return
+		}
+
+		follows := getFollows(event)
+		changed := !slices.Equal(wot_follows[event.PubKey], follows)
+		wot_follows[event.PubKey] = follows
+		wot_updated[event.PubKey] = event.CreatedAt
+
+		if changed {
+			scheduleWoTRefresh()
+		}
+	}()
+}
+
+// startWoT walks the graph for the first time in the background
+func startWoT() {
+	wot_once.Do(func() {
+		go RefreshWoT()
+	})
+}
+
+// scheduleWoTRefresh walks the graph again shortly, unless a walk is already scheduled
+func scheduleWoTRefresh() {
+	if wot_pending.CompareAndSwap(false, true) {
+		time.AfterFunc(WOT_REFRESH_DELAY, func() {
+			wot_pending.Store(false)
+			RefreshWoT()
+		})
+	}
+}
+
+// RefreshWoT walks the follow graph outwards from the admins, one hop at a time. Beyond
+// the admins' own follows, a pubkey must be followed by RELAY_WOT_MIN_FOLLOWERS pubkeys
+// that are already trusted.
+func RefreshWoT() {
+	wot_refresh_mu.Lock()
+	defer wot_refresh_mu.Unlock()
+
+	trusted := make(map[string]int)
+	frontier := slices.Clone(RELAY_ADMINS)
+
+	for _, pubkey := range RELAY_ADMINS {
+		trusted[pubkey] = 0
+	}
+
+	for depth := 1; depth <= RELAY_WOT_DEPTH && len(frontier) > 0; depth++ {
+		loadContactLists(frontier)
+
+		followers := make(map[string]int)
+		for pubkey := range trusted {
+			for _, follow := range wot_follows[pubkey] {
+				if _, ok := trusted[follow]; !ok {
+					followers[follow]++
+				}
+			}
+		}
+
+		frontier = make([]string, 0)
+		for pubkey, count := range followers {
+			if depth == 1 && isFollowedByAdmin(pubkey) || count >= RELAY_WOT_MIN_FOLLOWERS {
+				frontier = append(frontier, pubkey)
+			}
+		}
+
+		for _, pubkey := range frontier {
+			trusted[pubkey] = depth
+		}
+	}
+
+	// Forget contact lists that no longer count towards the graph
+	for pubkey := range wot_follows {
+		if depth, ok := trusted[pubkey]; !ok || depth >= RELAY_WOT_DEPTH {
+			delete(wot_follows, pubkey)
+			delete(wot_updated, pubkey)
+		}
+	}
+
+	wot_mu.Lock()
+	wot_trusted = trusted
+	wot_mu.Unlock()
+}
+
+// isFollowedByAdmin must be called with wot_refresh_mu held
+func isFollowedByAdmin(pubkey string) bool {
+	for _, admin := range RELAY_ADMINS {
+		if slices.Contains(wot_follows[admin], pubkey) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// loadContactLists must be called with wot_refresh_mu held
+func loadContactLists(pubkeys []string) {
+	missing := make([]string, 0)
+	for _, pubkey := range pubkeys {
+		if _, ok := wot_follows[pubkey]; !ok {
+			missing = append(missing, pubkey)
+			wot_follows[pubkey] = []string{}
+		}
+	}
+
+	for chunk := range slices.Chunk(missing, WOT_QUERY_CHUNK) {
+		ch, err := GetBackend().QueryEvents(context.Background(), nostr.Filter{
+			Kinds:   []int{nostr.KindFollowList},
+			Authors: chunk,
+			Limit:   len(chunk),
+		})
+		if err != nil {
+			log.Println("failed to query contact lists", err)
+			continue
+		}
+
+		latest := make(map[string]*nostr.Event)
+		for event := range ch {
+			if previous, ok := latest[event.PubKey]; !ok || previous.CreatedAt < event.CreatedAt {
+				latest[event.PubKey] = event
+			}
+		}
+
+		for pubkey, event := range latest {
+			wot_follows[pubkey] = getFollows(event)
+			wot_updated[pubkey] = event.CreatedAt
+		}
+	}
+}
+
+func getFollows(event *nostr.Event) []string {
+	follows := make([]string, 0)
+
+	for _, tag := range event.Tags {
+		if len(tag) >= 2 && tag[0] == "p" && nostr.IsValidPublicKey(tag[1]) {
+			follows = append(follows, tag[1])
+		}
+	}
+
+	return follows
+}
@@ -0,0 +1,120 @@
+package common
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// useTestWoT enables the web of trust with nothing loaded yet
+func useTestWoT(t *testing.T, depth int) {
+	reset := func(depth int) {
+		wot_refresh_mu.Lock()
+		defer wot_refresh_mu.Unlock()
+
+		RELAY_WOT_DEPTH = depth
+		wot_follows = make(map[string][]string)
+		wot_updated = make(map[string]nostr.Timestamp)
+		wot_trusted = make(map[string]int)
+		wot_once = sync.Once{}
+	}
+
+	previous := RELAY_WOT_DEPTH
+	t.Cleanup(func() { reset(previous) })
+
+	reset(depth)
+}
+
+func saveContactList(t *testing.T, secret string, follows ...string) *nostr.Event {
+	event := &nostr.Event{Kind: nostr.KindFollowList, CreatedAt: nostr.Now()}
+	for _, follow := range follows {
+		event.Tags = append(event.Tags, nostr.Tag{"p", follow})
+	}
+
+	event.Sign(secret)
+
+	if err := GetBackend().SaveEvent(context.Background(), event); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { GetBackend().DeleteEvent(context.Background(), event) })
+
+	return event
+}
+
+// waitForWoT polls until pubkey's access matches expected, since the graph is walked in the background
+func waitForWoT(pubkey string, expected bool) bool {
+	for range 200 {
+		if HasAccessUsingWoT(pubkey) == expected {
+			return true
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return false
+}
+
+func TestWoTLoadsContactListsInBackground(t *testing.T) {
+	useTestWoT(t, 2)
+
+	follows := make([]string, 0)
+	_, friendOfFriend := testKeypair()
+
+	// More contact lists than a query returns by default
+	for range 300 {
+		secret, pubkey := testKeypair()
+		saveContactList(t, secret, friendOfFriend)
+		follows = append(follows, pubkey)
+	}
+
+	saveContactList(t, testAdminSecret, follows...)
+
+	_, stranger := testKeypair()
+
+	if !waitForWoT(friendOfFriend, true) || !waitForWoT(follows[299], true) {
+		t.Fatalf("expected follows and their follows to be trusted")
+	}
+
+	if HasAccessUsingWoT(stranger) {
+		t.Fatalf("expected pubkeys outside the graph not to be trusted")
+	}
+
+	wot_refresh_mu.Lock()
+	loaded := len(wot_follows)
+	wot_refresh_mu.Unlock()
+
+	if loaded != len(follows)+1 {
+		t.Fatalf("expected every contact list to be loaded, got %d", loaded)
+	}
+}
+
+func TestWoTHandlesContactListsBeforeFirstWalk(t *testing.T) {
+	useTestWoT(t, 1)
+
+	_, friend := testKeypair()
+
+	// Walking the graph mustn't hold up saving the event
+	done := make(chan struct{})
+
+	wot_refresh_mu.Lock()
+	go func() {
+		HandleContactList(saveContactList(t, testAdminSecret, friend))
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("expected contact lists to be handled without waiting for a walk")
+	}
+
+	wot_refresh_mu.Unlock()
+
+	if !waitForWoT(friend, true) {
+		t.Fatalf("expected the first walk to include the new contact list")
+	}
+}
@@ -19,6 +19,22 @@ import (
 	"github.com/spf13/afero"
 )
 
+func rejectBlossom(auth *nostr.Event, action string) (bool, string) {
+	if auth == nil {
+		return true, "unauthorized"
+	}
+
+	if granted, reason := common.CheckAccess(common.AccessRequest{PubKey: auth.PubKey, Action: action}); !granted {
+		if reason == "" {
+			reason = "unauthorized"
+		}
+
+		return true, reason
+	}
+
+	return false, ""
+}
+
 func main() {
 	common.SetupEnvironment()
 
@@ -50,10 +66,38 @@ func main() {
 	defer ticker.Stop()
 	defer common.GetDatabase().Close()
 
+	// Prune lapsed memberships, bans, and unpaid invoices
+	pruneTicker := time.NewTicker(time.Hour)
+	go func() {
+		for {
+			select {
+			case <-pruneTicker.C:
+				for _, pubkey := range common.PruneExpiredClaims() {
+					log.Printf("Membership lapsed for %s", pubkey)
+					common.UpdateMembership(pubkey)
+				}
+
+				for _, pubkey := range common.PruneExpiredBans() {
+					log.Printf("Ban expired for %s", pubkey)
+				}
+
+				if n := common.PruneExpiredInvoices(ctx); n > 0 {
+					log.Printf("Discarded %d unpaid invoices", n)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	defer pruneTicker.Stop()
+
 	// Relay
 
 	relay := common.GetRelay()
 
+	common.SyncMembership()
+
 	// Blossom
 
 	if common.RELAY_ENABLE_BLOSSOM {
@@ -94,37 +138,62 @@ func main() {
 			return fs.Remove(blossomPath + "/" + sha256)
 		})
 
+		// Delete uploads when a banned pubkey's content is purged, keeping blobs others still own
+		common.PurgeHooks["blossom uploads"] = func(ctx context.Context, pubkey string) (int, error) {
+			ch, err := bl.Store.List(ctx, pubkey)
+			if err != nil {
+				return 0, err
+			}
+
+			blobs := make([]string, 0)
+			for blob := range ch {
+				blobs = append(blobs, blob.SHA256)
+			}
+
+			for _, sha256 := range blobs {
+				if err := bl.Store.Delete(ctx, sha256, pubkey); err != nil {
+					return 0, err
+				}
+
+				if bd, err := bl.Store.Get(ctx, sha256); err == nil && bd == nil {
+					fs.Remove(blossomPath + "/" + sha256)
+				}
+			}
+
+			return len(blobs), nil
+		}
+
 		bl.RejectUpload = append(bl.RejectUpload, func(ctx context.Context, auth *nostr.Event, size int, ext string) (bool, string, int) {
 			if size > 10*1024*1024 {
 				return true, "file too large", 413
 			}
 
-			if auth == nil || !common.HasAccess(auth.PubKey) {
-				return true, "unauthorized", 403
+			if reject, msg := rejectBlossom(auth, common.CAP_UPLOAD); reject {
+				return true, msg, 403
 			}
 
 			return false, ext, size
 		})
 
 		bl.RejectGet = append(bl.RejectGet, func(ctx context.Context, auth *nostr.Event, sha256 string) (bool, string, int) {
-			if auth == nil || !common.HasAccess(auth.PubKey) {
-				return true, "unauthorized", 403
+			if reject, msg := rejectBlossom(auth, common.CAP_READ); reject {
+				return true, msg, 403
 			}
 
 			return false, "", 200
 		})
 
 		bl.RejectList = append(bl.RejectList, func(ctx context.Context, auth *nostr.Event, pubkey string) (bool, string, int) {
-			if auth == nil || !common.HasAccess(auth.PubKey) {
-				return true, "unauthorized", 403
+			if reject, msg := rejectBlossom(auth, common.CAP_READ); reject {
+				return true, msg, 403
 			}
 
 			return false, "", 200
 		})
 
 		bl.RejectDelete = append(bl.RejectDelete, func(ctx context.Context, auth *nostr.Event, sha256 string) (bool, string, int) {
-			if auth == nil || !common.HasAccess(auth.PubKey) {
-				return true, "unauthorized", 403
+			if reject, msg := rejectBlossom(auth, common.CAP_UPLOAD); reject {
+				return true, msg, 403
 			}
 
 			return false, "", 200
@@ -143,7 +212,7 @@ func main() {
 	// Create server
 	srv := &http.Server{
 		Addr:    fmt.Sprintf(":%s", common.PORT),
-		Handler: relay,
+		Handler: common.WithRelaySelf(common.WithManagementExtensions(relay)),
 	}
 
 	// Start server in goroutine